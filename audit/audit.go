@@ -0,0 +1,274 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sshtalk/logger"
+)
+
+// Content 决定审计日志如何记录提示和回复的内容
+type Content string
+
+const (
+	ContentFull Content = "full" // 原文
+	ContentHash Content = "hash" // 只记录 SHA-256，可以核对内容但无法还原
+	ContentOmit Content = "omit" // 不记录内容
+)
+
+// 单个审计日志文件的默认大小上限，超过后轮转
+const defaultMaxSizeMB = 100
+
+// 审计结果
+const (
+	OutcomeOK        = "ok"
+	OutcomeError     = "error"
+	OutcomeCancelled = "cancelled"
+	OutcomeBlocked   = "blocked"
+)
+
+// blocker 由被使用策略拒绝的错误实现
+type blocker interface {
+	Blocked() bool
+}
+
+// Actor 是发起请求的人，由 SSH 会话或 HTTP 认证中间件放入 context
+type Actor struct {
+	Source     string // ssh、terminal（网页终端）、http 或 room
+	Identity   string // 公钥指纹或令牌所有者
+	Token      string // 令牌名称，仅 HTTP 请求有
+	User       string // SSH 用户名或聊天室中的名字
+	RemoteAddr string
+}
+
+type actorKey struct{}
+
+// WithActor 返回带有请求者信息的 context
+func WithActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, a)
+}
+
+// ActorFrom 返回 context 中的请求者信息
+func ActorFrom(ctx context.Context) (Actor, bool) {
+	a, ok := ctx.Value(actorKey{}).(Actor)
+	return a, ok
+}
+
+// Entry 是审计日志中的一行，记录一轮完整的提问和回复
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"`
+	Identity   string    `json:"identity,omitempty"`
+	Token      string    `json:"token,omitempty"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	SessionID  string    `json:"session_id,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+
+	Model            string `json:"model,omitempty"`
+	Prompt           string `json:"prompt,omitempty"`
+	Response         string `json:"response,omitempty"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+	Outcome          string `json:"outcome"`
+	Error            string `json:"error,omitempty"`
+	DurationMS       int64  `json:"duration_ms"`
+}
+
+// Outcome 根据错误返回审计结果
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return OutcomeOK
+	case errors.Is(err, context.Canceled):
+		return OutcomeCancelled
+	case isBlocked(err):
+		return OutcomeBlocked
+	default:
+		return OutcomeError
+	}
+}
+
+func isBlocked(err error) bool {
+	var b blocker
+	return errors.As(err, &b) && b.Blocked()
+}
+
+// Log 是只追加的 JSONL 审计日志，文件超过大小上限时改名保存并开始新文件
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	content Content
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+var (
+	defaultLog     *Log
+	defaultLogErr  error
+	defaultLogOnce sync.Once
+)
+
+// Default 返回按环境变量配置的审计日志，SSHTALK_AUDIT_FILE 为空时返回 nil（不记录）。
+// SSHTALK_AUDIT_CONTENT 为 full（默认）、hash 或 omit，
+// SSHTALK_AUDIT_MAX_SIZE_MB 是轮转前单个文件的大小上限，默认 100
+func Default() (*Log, error) {
+	defaultLogOnce.Do(func() {
+		path := os.Getenv("SSHTALK_AUDIT_FILE")
+		if path == "" {
+			return
+		}
+		content := Content(strings.ToLower(os.Getenv("SSHTALK_AUDIT_CONTENT")))
+		if content == "" {
+			content = ContentFull
+		}
+		maxSize := defaultMaxSizeMB
+		if v := os.Getenv("SSHTALK_AUDIT_MAX_SIZE_MB"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				defaultLogErr = fmt.Errorf("invalid SSHTALK_AUDIT_MAX_SIZE_MB %q", v)
+				return
+			}
+			maxSize = n
+		}
+		defaultLog, defaultLogErr = Open(path, content, int64(maxSize)<<20)
+	})
+	return defaultLog, defaultLogErr
+}
+
+// Open 打开审计日志，文件不存在时创建
+func Open(path string, content Content, maxSize int64) (*Log, error) {
+	switch content {
+	case ContentFull, ContentHash, ContentOmit:
+	default:
+		return nil, fmt.Errorf("unknown audit content mode %q, expected full, hash or omit", content)
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	l := &Log{path: path, content: content, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate 把当前文件改名为带时间戳的文件，例如 audit.jsonl 改为 audit-20060102T150405.000.jsonl
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(l.path)
+	base := strings.TrimSuffix(l.path, ext) + "-" + time.Now().UTC().Format("20060102T150405.000")
+	// 同一毫秒内多次轮转时加序号，不能覆盖已有的文件
+	rotated := base + ext
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		rotated = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Write 追加一条记录，按配置处理提示和回复的内容
+func (l *Log) Write(e Entry) error {
+	switch l.content {
+	case ContentHash:
+		e.Prompt = hash(e.Prompt)
+		e.Response = hash(e.Response)
+	case ContentOmit:
+		e.Prompt = ""
+		e.Response = ""
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func hash(s string) string {
+	if s == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// RecordBlocked 记录在请求模型之前就被拒绝的一轮，err 是拒绝的原因。
+// 被敏感内容检查拒绝的消息 prompt 应传空，敏感内容不写入审计日志
+func RecordBlocked(ctx context.Context, model, prompt string, err error) {
+	Record(ctx, Entry{Model: model, Prompt: prompt, Outcome: Outcome(err), Error: err.Error()})
+}
+
+// Record 把一轮对话写入默认的审计日志。请求者和会话 ID、请求 ID 取自 ctx，
+// 没有配置审计日志时什么也不做，写入失败只记录错误日志
+func Record(ctx context.Context, e Entry) {
+	l, err := Default()
+	if l == nil || err != nil {
+		return
+	}
+	e.Time = time.Now()
+	if a, ok := ActorFrom(ctx); ok {
+		e.Source = a.Source
+		e.Identity = a.Identity
+		e.Token = a.Token
+		e.User = a.User
+		e.RemoteAddr = a.RemoteAddr
+	}
+	for _, attr := range logger.Attrs(ctx) {
+		switch attr.Key {
+		case "session_id":
+			e.SessionID = attr.Value.String()
+		case "request_id":
+			e.RequestID = attr.Value.String()
+		}
+	}
+	if err := l.Write(e); err != nil {
+		slog.ErrorContext(ctx, "failed to write audit log", "err", err)
+	}
+}
@@ -0,0 +1,284 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sshtalk/store"
+)
+
+// Scope 限定令牌可以访问的接口
+type Scope string
+
+// 令牌权限，从低到高依次包含
+const (
+	ScopeReadOnly Scope = "read-only" // 只能读取对话、搜索和模型列表
+	ScopeChat     Scope = "chat"      // 可以聊天和修改自己的对话
+	ScopeAdmin    Scope = "admin"     // 可以访问管理接口
+)
+
+// 令牌前缀，便于在日志和配置中识别
+const tokenPrefix = "sst_"
+
+var scopeLevel = map[Scope]int{ScopeReadOnly: 1, ScopeChat: 2, ScopeAdmin: 3}
+
+// ParseScope 检查权限名称是否有效
+func ParseScope(s string) (Scope, error) {
+	if _, ok := scopeLevel[Scope(s)]; !ok {
+		return "", fmt.Errorf("invalid scope %q, must be one of read-only, chat, admin", s)
+	}
+	return Scope(s), nil
+}
+
+// Allows 判断当前权限是否包含 required
+func (s Scope) Allows(required Scope) bool {
+	return scopeLevel[s] >= scopeLevel[required]
+}
+
+// 验证失败的原因
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+	ErrNotFound     = errors.New("token not found")
+)
+
+// Token 是保存的令牌信息，只保存令牌的 SHA-256，明文只在创建时返回一次
+type Token struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scope   Scope     `json:"scope"`
+	Owner   string    `json:"owner"` // 使用令牌时的身份，与 SSH 会话的身份一致时共享对话
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"` // 零值表示永不过期
+}
+
+// Expired 判断令牌是否已过期
+func (t Token) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+// Store 把令牌保存在数据目录的 tokens.json 中。
+// 命令行和服务进程可能同时修改，读取时按文件修改时间刷新缓存
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	tokens  []Token
+}
+
+var (
+	defaultStore    *Store
+	defaultStoreErr error
+	defaultOnce     sync.Once
+)
+
+// Default 返回与对话存储相同数据目录下的令牌存储
+func Default() (*Store, error) {
+	defaultOnce.Do(func() {
+		st, err := store.Default()
+		if err != nil {
+			defaultStoreErr = err
+			return
+		}
+		defaultStore = Open(st.Dir())
+	})
+	return defaultStore, defaultStoreErr
+}
+
+// Open 打开 dir 下的令牌存储
+func Open(dir string) *Store {
+	return &Store{path: filepath.Join(dir, "tokens.json")}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// load 在文件有变化时重新读取，调用者需持有 s.mu
+func (s *Store) load() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.tokens, s.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("parse %s: %w", s.path, err)
+	}
+	s.tokens, s.modTime = tokens, info.ModTime()
+	return nil
+}
+
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := store.WriteFileAtomic(s.path, data, 0o600); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Create 生成新令牌，返回令牌信息和只显示一次的明文。ttl 为 0 表示永不过期
+func (s *Store) Create(name string, scope Scope, owner string, ttl time.Duration) (Token, string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return Token{}, "", err
+	}
+	plain := tokenPrefix + hex.EncodeToString(secret)
+
+	t := Token{
+		ID:      store.NewID()[:8],
+		Name:    name,
+		Scope:   scope,
+		Owner:   owner,
+		Hash:    hashToken(plain),
+		Created: time.Now(),
+	}
+	if ttl > 0 {
+		t.Expires = t.Created.Add(ttl)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return Token{}, "", err
+	}
+	for _, existing := range s.tokens {
+		if existing.Owner == owner && existing.Name == name {
+			return Token{}, "", fmt.Errorf("a token named %q already exists", name)
+		}
+	}
+	s.tokens = append(s.tokens, t)
+	if err := s.save(); err != nil {
+		return Token{}, "", err
+	}
+	return t, plain, nil
+}
+
+// List 返回所有令牌，按创建时间排序
+func (s *Store) List() ([]Token, error) {
+	return s.ListOwned("")
+}
+
+// ListOwned 返回 owner 的令牌，owner 为空时返回所有令牌
+func (s *Store) ListOwned(owner string) ([]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	var list []Token
+	for _, t := range s.tokens {
+		if owner == "" || t.Owner == owner {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// Revoke 按 ID 或名称删除令牌，返回被删除的令牌
+func (s *Store) Revoke(idOrName string) (Token, error) {
+	return s.RevokeOwned("", ScopeAdmin, idOrName)
+}
+
+// RevokeOwned 删除属于 owner 的令牌，owner 为空时不限所有者。
+// 权限高于 scope 的令牌不会被删除，用于防止低权限的调用者撤销管理令牌。
+// 不同所有者的令牌可能同名，名称匹配多个令牌时需要使用 ID
+func (s *Store) RevokeOwned(owner string, scope Scope, idOrName string) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return Token{}, err
+	}
+	found := -1
+	for i, t := range s.tokens {
+		if (owner != "" && t.Owner != owner) || !scope.Allows(t.Scope) {
+			continue
+		}
+		if t.ID == idOrName {
+			found = i
+			break
+		}
+		if t.Name == idOrName {
+			if found >= 0 {
+				return Token{}, fmt.Errorf("more than one token is named %q, revoke it by ID", idOrName)
+			}
+			found = i
+		}
+	}
+	if found < 0 {
+		return Token{}, ErrNotFound
+	}
+	t := s.tokens[found]
+	s.tokens = append(s.tokens[:found:found], s.tokens[found+1:]...)
+	return t, s.save()
+}
+
+// Verify 校验明文令牌
+func (s *Store) Verify(plain string) (Token, error) {
+	if !strings.HasPrefix(plain, tokenPrefix) {
+		return Token{}, ErrInvalidToken
+	}
+	hash := hashToken(plain)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return Token{}, err
+	}
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			if t.Expired() {
+				return Token{}, ErrExpiredToken
+			}
+			return t, nil
+		}
+	}
+	return Token{}, ErrInvalidToken
+}
+
+type tokenKey struct{}
+
+// WithToken 把通过验证的令牌放入 context
+func WithToken(ctx context.Context, t Token) context.Context {
+	return context.WithValue(ctx, tokenKey{}, t)
+}
+
+// FromContext 取出请求使用的令牌
+func FromContext(ctx context.Context) (Token, bool) {
+	t, ok := ctx.Value(tokenKey{}).(Token)
+	return t, ok
+}
@@ -2,9 +2,13 @@ package cmd
 
 import (
 	"log"
+	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
+
+	"sshtalk/logger"
 )
 
 func Execute() {
@@ -25,16 +29,33 @@ var rootCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(sshCmd)
 	rootCmd.AddCommand(httpCmd)
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().String("owner", "local", "identity that owns the imported conversations, e.g. key:SHA256:... for an SSH user")
+
+	rootCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenRevokeCmd)
+	tokenCreateCmd.Flags().String("scope", "chat", "token scope: read-only, chat or admin")
+	tokenCreateCmd.Flags().String("expires", "", "lifetime such as 12h or 30d, never expires when empty")
+	tokenCreateCmd.Flags().String("owner", "local", "identity whose conversations the token can access, e.g. key:SHA256:... for an SSH user")
+
+	rootCmd.AddCommand(hostkeyCmd)
+	hostkeyCmd.AddCommand(hostkeyFingerprintCmd)
+
+	rootCmd.AddCommand(announceCmd)
+	announceCmd.AddCommand(announceShowCmd, announceSetCmd, announceClearCmd)
 }
 
 var sshCmd = &cobra.Command{
 	Use:   "ssh",
 	Short: "Run as SSH server",
 	Run: func(cmd *cobra.Command, args []string) {
+		logger.Setup()
 		if os.Getenv("PORT") == "" {
-			log.Fatal("PORT is not set for SSH server mode")
+			slog.Error("PORT is not set for SSH server mode")
+			os.Exit(1)
 		}
-		log.Println("Starting in SSH server mode...")
+		slog.Info("starting in SSH server mode")
 		startSSHServer()
 	},
 }
@@ -43,10 +64,103 @@ var httpCmd = &cobra.Command{
 	Use:   "http",
 	Short: "Run as HTTP server",
 	Run: func(cmd *cobra.Command, args []string) {
+		logger.Setup()
 		if os.Getenv("PORT") == "" {
-			log.Fatal("PORT is not set for HTTP server mode")
+			slog.Error("PORT is not set for HTTP server mode")
+			os.Exit(1)
 		}
-		log.Println("Starting in HTTP server mode...")
+		slog.Info("starting in HTTP server mode")
 		startHttpServer()
 	},
 }
+
+var importCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Import conversations from a ChatGPT conversations.json export or a JSONL file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		owner, _ := cmd.Flags().GetString("owner")
+		importConversations(args[0], owner)
+	},
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage API tokens for the HTTP server",
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create an API token and print it once",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		scope, _ := cmd.Flags().GetString("scope")
+		expires, _ := cmd.Flags().GetString("expires")
+		owner, _ := cmd.Flags().GetString("owner")
+		createToken(args[0], scope, expires, owner)
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List API tokens",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		listTokens()
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <id|name>",
+	Short: "Revoke an API token",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revokeToken(args[0])
+	},
+}
+
+var hostkeyCmd = &cobra.Command{
+	Use:   "hostkey",
+	Short: "Manage the SSH server's host keys",
+}
+
+var hostkeyFingerprintCmd = &cobra.Command{
+	Use:   "fingerprint",
+	Short: "Print the fingerprints of the SSH host keys",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		printHostKeyFingerprints()
+	},
+}
+
+var announceCmd = &cobra.Command{
+	Use:   "announce",
+	Short: "Manage the announcement shown in the welcome message",
+}
+
+var announceShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the current announcement",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		showAnnouncement()
+	},
+}
+
+var announceSetCmd = &cobra.Command{
+	Use:   "set <text>",
+	Short: "Publish an announcement for sessions that start from now on",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		setAnnouncement(strings.Join(args, " "))
+	},
+}
+
+var announceClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Remove the announcement",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		setAnnouncement("")
+	},
+}
@@ -1,8 +1,24 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"sshtalk/auth"
+	"sshtalk/conversation"
+	"sshtalk/hostkey"
+	"sshtalk/motd"
 	httpServer "sshtalk/server/http"
 	sshServer "sshtalk/server/ssh"
+	"sshtalk/store"
+	"sshtalk/tracing"
 	"sshtalk/ui"
 )
 
@@ -13,10 +29,195 @@ func startLocalUI() {
 
 // SSH 服务器适配器
 func startSSHServer() {
+	defer startTracing()()
 	sshServer.Start()
 }
 
 // HTTP 服务器适配器
 func startHttpServer() {
+	defer startTracing()()
 	httpServer.Start()
 }
+
+// startTracing 配置链路追踪，返回退出前导出剩余 span 的函数
+func startTracing() func() {
+	shutdown, err := tracing.Setup(context.Background())
+	if err != nil {
+		slog.Error("failed to set up tracing", "err", err)
+		os.Exit(1)
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Warn("failed to flush traces", "err", err)
+		}
+	}
+}
+
+// 导入对话到存储
+func importConversations(path, owner string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	convs, err := conversation.Import(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	st, err := store.Default()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 已经导入过的对话按来源 ID 跳过，重复导入同一个文件不会产生重复的对话
+	existing, err := st.List(owner)
+	if err != nil {
+		log.Fatal(err)
+	}
+	imported := map[string]string{}
+	for _, c := range existing {
+		if c.Source != "" {
+			imported[c.Source] = c.ID
+		}
+	}
+	added := 0
+	for i := range convs {
+		c := &convs[i]
+		if c.Title == "" {
+			c.Title = c.DefaultTitle()
+		}
+		if id, ok := imported[c.Source]; ok {
+			fmt.Printf("%s  %s (already imported)\n", id, c.Title)
+			continue
+		}
+		c.Owner = owner
+		if err := st.Put(c); err != nil {
+			log.Fatal(err)
+		}
+		if c.Source != "" {
+			imported[c.Source] = c.ID
+		}
+		added++
+		fmt.Printf("%s  %s (%d messages)\n", c.ID, c.Title, len(c.Messages))
+	}
+	fmt.Printf("Imported %d of %d conversations into %s\n", added, len(convs), st.Dir())
+}
+
+// parseTTL 解析令牌有效期，在 time.ParseDuration 的基础上支持天数，例如 30d
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid lifetime %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid lifetime %q", s)
+	}
+	return d, nil
+}
+
+func tokenStore() *auth.Store {
+	tokens, err := auth.Default()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tokens
+}
+
+// 创建 API 令牌
+func createToken(name, scope, expires, owner string) {
+	sc, err := auth.ParseScope(scope)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ttl, err := parseTTL(expires)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t, plain, err := tokenStore().Create(name, sc, owner, ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Created token %s (%s, scope %s)\n", t.ID, t.Name, t.Scope)
+	fmt.Println("Store it now, it will not be shown again:")
+	fmt.Println(plain)
+}
+
+// 列出 API 令牌
+func listTokens() {
+	list, err := tokenStore().List()
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSCOPE\tOWNER\tCREATED\tEXPIRES")
+	for _, t := range list {
+		expires := "never"
+		if !t.Expires.IsZero() {
+			expires = t.Expires.Format("2006-01-02 15:04")
+			if t.Expired() {
+				expires += " (expired)"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, t.Scope, t.Owner, t.Created.Format("2006-01-02 15:04"), expires)
+	}
+	w.Flush()
+}
+
+// 吊销 API 令牌
+func revokeToken(idOrName string) {
+	t, err := tokenStore().Revoke(idOrName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Revoked token %s (%s)\n", t.ID, t.Name)
+}
+
+// 打印 SSH 主机密钥的指纹，用户第一次连接时可以核对
+func printHostKeyFingerprints() {
+	dir, err := hostkey.Dir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys, err := hostkey.Load(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(keys) == 0 {
+		log.Fatalf("no host keys in %s, they are generated when the SSH server starts", dir)
+	}
+	for _, k := range keys {
+		fmt.Println(k.Fingerprint())
+	}
+}
+
+// 打印当前的公告
+func showAnnouncement() {
+	text, err := motd.Announcement()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if text == "" {
+		fmt.Println("No announcement")
+		return
+	}
+	fmt.Println(text)
+}
+
+// 发布或清除公告，之后开始的会话会在欢迎消息中看到
+func setAnnouncement(text string) {
+	if err := motd.SetAnnouncement(text); err != nil {
+		log.Fatal(err)
+	}
+	if strings.TrimSpace(text) == "" {
+		fmt.Println("Announcement cleared")
+		return
+	}
+	fmt.Println("Announcement published")
+}
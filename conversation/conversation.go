@@ -0,0 +1,58 @@
+package conversation
+
+import (
+	"time"
+)
+
+// 消息角色
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool"
+)
+
+// Message 是对话中的一条消息
+type Message struct {
+	Role             string    `json:"role"`
+	Name             string    `json:"name,omitempty"` // 聊天室中的发送者
+	Content          string    `json:"content"`
+	Time             time.Time `json:"time"`
+	Model            string    `json:"model,omitempty"`
+	PromptTokens     int64     `json:"prompt_tokens,omitempty"`
+	CompletionTokens int64     `json:"completion_tokens,omitempty"`
+}
+
+// Conversation 是一段完整的对话
+type Conversation struct {
+	ID       string    `json:"id,omitempty"`
+	Owner    string    `json:"owner,omitempty"`  // 所属身份，见 ui.Options.Identity
+	Source   string    `json:"source,omitempty"` // 导入时原来的对话 ID，重复导入时用来跳过已有的对话
+	Title    string    `json:"title"`
+	Model    string    `json:"model"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Messages []Message `json:"messages"`
+}
+
+// Usage 返回整段对话消耗的 token 数
+func (c Conversation) Usage() (prompt, completion int64) {
+	for _, m := range c.Messages {
+		prompt += m.PromptTokens
+		completion += m.CompletionTokens
+	}
+	return prompt, completion
+}
+
+// DefaultTitle 使用第一条用户消息作为标题
+func (c Conversation) DefaultTitle() string {
+	for _, m := range c.Messages {
+		if m.Role == RoleUser {
+			title := []rune(m.Content)
+			if len(title) > 60 {
+				return string(title[:60]) + "…"
+			}
+			return string(title)
+		}
+	}
+	return "Untitled"
+}
@@ -0,0 +1,100 @@
+package conversation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+// 支持的导出格式
+const (
+	FormatMarkdown = "md"
+	FormatJSON     = "json"
+	FormatHTML     = "html"
+)
+
+// Export 把对话渲染为指定格式
+func Export(c Conversation, format string) ([]byte, error) {
+	switch format {
+	case FormatMarkdown, "":
+		return exportMarkdown(c), nil
+	case FormatJSON:
+		return json.MarshalIndent(c, "", "  ")
+	case FormatHTML:
+		return exportHTML(c)
+	}
+	return nil, fmt.Errorf("unsupported export format %q", format)
+}
+
+// FileName 返回导出文件的默认文件名
+func FileName(c Conversation, format string) string {
+	if format == "" {
+		format = FormatMarkdown
+	}
+	return fmt.Sprintf("sshtalk-%s.%s", c.Created.Format("20060102-150405"), format)
+}
+
+func speaker(m Message) string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.Role
+}
+
+func exportMarkdown(c Conversation) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", c.Title)
+	fmt.Fprintf(&b, "- Model: %s\n", c.Model)
+	fmt.Fprintf(&b, "- Created: %s\n", c.Created.Format(time.RFC3339))
+	prompt, completion := c.Usage()
+	fmt.Fprintf(&b, "- Usage: %d prompt tokens, %d completion tokens\n", prompt, completion)
+
+	for _, m := range c.Messages {
+		fmt.Fprintf(&b, "\n## %s · %s\n\n", speaker(m), m.Time.Format(time.RFC3339))
+		b.WriteString(m.Content)
+		b.WriteString("\n")
+		if m.PromptTokens > 0 || m.CompletionTokens > 0 {
+			fmt.Fprintf(&b, "\n_%d prompt / %d completion tokens_\n", m.PromptTokens, m.CompletionTokens)
+		}
+	}
+	return []byte(b.String())
+}
+
+var htmlTemplate = template.Must(template.New("conversation").Funcs(template.FuncMap{
+	"speaker": speaker,
+	"time":    func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Conversation.Title}}</title>
+<style>
+body { font-family: ui-monospace, monospace; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; }
+.msg { margin: 1rem 0; padding: .5rem .75rem; border-radius: .375rem; white-space: pre-wrap; }
+.user { border: 1px solid #888; margin-left: 25%; }
+.meta { color: #888; font-size: .75rem; margin-bottom: .25rem; }
+</style>
+</head>
+<body>
+<h1>{{.Conversation.Title}}</h1>
+<p class="meta">Model {{.Conversation.Model}} · {{time .Conversation.Created}} · {{.Prompt}} prompt / {{.Completion}} completion tokens</p>
+{{range .Conversation.Messages}}<div class="msg {{.Role}}">
+<div class="meta">{{speaker .}} · {{time .Time}}{{if .CompletionTokens}} · {{.PromptTokens}}/{{.CompletionTokens}} tokens{{end}}</div>
+{{.Content}}</div>
+{{end}}</body>
+</html>
+`))
+
+func exportHTML(c Conversation) ([]byte, error) {
+	prompt, completion := c.Usage()
+	var buf bytes.Buffer
+	err := htmlTemplate.Execute(&buf, struct {
+		Conversation Conversation
+		Prompt       int64
+		Completion   int64
+	}{c, prompt, completion})
+	return buf.Bytes(), err
+}
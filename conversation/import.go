@@ -0,0 +1,194 @@
+package conversation
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Import 解析 ChatGPT 导出的 conversations.json 或 JSONL 格式的消息，根据内容自动识别格式
+func Import(data []byte) ([]Conversation, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return ImportChatGPT(trimmed)
+	}
+	return ImportJSONL(trimmed)
+}
+
+type chatGPTConversation struct {
+	ID             string                 `json:"id"`
+	ConversationID string                 `json:"conversation_id"`
+	Title          string                 `json:"title"`
+	CreateTime     float64                `json:"create_time"`
+	UpdateTime     float64                `json:"update_time"`
+	CurrentNode    string                 `json:"current_node"`
+	Mapping        map[string]chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	Parent  string `json:"parent"`
+	Message *struct {
+		Author struct {
+			Role string `json:"role"`
+		} `json:"author"`
+		CreateTime float64 `json:"create_time"`
+		Content    struct {
+			ContentType string            `json:"content_type"`
+			Parts       []json.RawMessage `json:"parts"`
+			Text        string            `json:"text"`
+		} `json:"content"`
+		Metadata struct {
+			ModelSlug string `json:"model_slug"`
+		} `json:"metadata"`
+	} `json:"message"`
+}
+
+func unixTime(sec float64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	whole, frac := math.Modf(sec)
+	return time.Unix(int64(whole), int64(frac*1e9))
+}
+
+// ImportChatGPT 解析 ChatGPT 数据导出中的 conversations.json。
+// 导出中每段对话是一棵消息树，这里沿 current_node 回溯得到最终显示的那条分支
+func ImportChatGPT(data []byte) ([]Conversation, error) {
+	var raw []chatGPTConversation
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse conversations.json: %w", err)
+	}
+
+	convs := make([]Conversation, 0, len(raw))
+	for _, rc := range raw {
+		c := Conversation{
+			Title:   rc.Title,
+			Created: unixTime(rc.CreateTime),
+			Updated: unixTime(rc.UpdateTime),
+		}
+		switch {
+		case rc.ConversationID != "":
+			c.Source = "chatgpt:" + rc.ConversationID
+		case rc.ID != "":
+			c.Source = "chatgpt:" + rc.ID
+		}
+
+		var branch []Message
+		seen := map[string]bool{}
+		for id := rc.CurrentNode; id != "" && !seen[id]; id = rc.Mapping[id].Parent {
+			seen[id] = true
+			node := rc.Mapping[id]
+			if node.Message == nil {
+				continue
+			}
+			role := node.Message.Author.Role
+			if role != RoleUser && role != RoleAssistant {
+				continue
+			}
+
+			var texts []string
+			for _, part := range node.Message.Content.Parts {
+				var text string
+				// 非文本部分（图片等）是对象，跳过
+				if json.Unmarshal(part, &text) == nil && text != "" {
+					texts = append(texts, text)
+				}
+			}
+			content := strings.Join(texts, "\n")
+			if content == "" {
+				content = node.Message.Content.Text
+			}
+			if content == "" {
+				continue
+			}
+
+			msg := Message{
+				Role:    role,
+				Content: content,
+				Time:    unixTime(node.Message.CreateTime),
+			}
+			if role == RoleAssistant {
+				msg.Model = node.Message.Metadata.ModelSlug
+				if c.Model == "" {
+					c.Model = msg.Model
+				}
+			}
+			branch = append(branch, msg)
+		}
+
+		for i := len(branch) - 1; i >= 0; i-- {
+			c.Messages = append(c.Messages, branch[i])
+		}
+		if len(c.Messages) > 0 {
+			convs = append(convs, c)
+		}
+	}
+	return convs, nil
+}
+
+// jsonlMessage 是 JSONL 格式中的一行。conversation 相同的行属于同一段对话，省略时全部属于一段对话
+type jsonlMessage struct {
+	Conversation string    `json:"conversation"`
+	Title        string    `json:"title"`
+	Model        string    `json:"model"`
+	Role         string    `json:"role"`
+	Content      string    `json:"content"`
+	Time         time.Time `json:"time"`
+}
+
+// ImportJSONL 解析每行一条消息的 JSONL 文件
+func ImportJSONL(data []byte) ([]Conversation, error) {
+	var convs []Conversation
+	index := map[string]int{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var m jsonlMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if m.Role != RoleUser && m.Role != RoleAssistant && m.Role != RoleTool {
+			return nil, fmt.Errorf("line %d: unknown role %q", line, m.Role)
+		}
+
+		i, ok := index[m.Conversation]
+		if !ok {
+			i = len(convs)
+			index[m.Conversation] = i
+			convs = append(convs, Conversation{Created: m.Time})
+		}
+		c := &convs[i]
+		if m.Title != "" {
+			c.Title = m.Title
+		}
+		if m.Model != "" && c.Model == "" {
+			c.Model = m.Model
+		}
+		c.Messages = append(c.Messages, Message{Role: m.Role, Content: m.Content, Time: m.Time, Model: m.Model})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for key, i := range index {
+		convs[i].Source = jsonlSource(key, convs[i].Messages[0])
+	}
+	return convs, nil
+}
+
+// jsonlSource 返回 JSONL 中一段对话的来源 ID。conversation 字段只在一个文件内唯一，
+// 加上第一条消息后在不同文件之间也能区分，对话后来追加了消息也不会改变
+func jsonlSource(key string, first Message) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s", key, first.Time.UTC().Format(time.RFC3339Nano), first.Role, first.Content)
+	return "jsonl:" + hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,67 @@
+package drain
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// 默认的排空时间：收到退出信号后，进行中的回复最多还能生成这么久
+const defaultTimeout = 30 * time.Second
+
+// Grace 是截止时间之后留给会话保存对话和断开连接的时间
+const Grace = 5 * time.Second
+
+var (
+	mu       sync.Mutex
+	started  = make(chan struct{})
+	deadline time.Time
+)
+
+// Timeout 返回 SSHTALK_SHUTDOWN_TIMEOUT 配置的排空时间，默认 30s
+func Timeout() (time.Duration, error) {
+	v := os.Getenv("SSHTALK_SHUTDOWN_TIMEOUT")
+	if v == "" {
+		return defaultTimeout, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid SSHTALK_SHUTDOWN_TIMEOUT %q", v)
+	}
+	return d, nil
+}
+
+// Start 开始排空：所有会话停止接受新消息，进行中的回复在 until 之前完成，之后会话关闭。
+// 重复调用没有效果
+func Start(until time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	if Draining() {
+		return
+	}
+	deadline = until
+	close(started)
+}
+
+// Started 返回开始排空时关闭的通道
+func Started() <-chan struct{} {
+	return started
+}
+
+// Draining 报告服务器是否正在关闭
+func Draining() bool {
+	select {
+	case <-started:
+		return true
+	default:
+		return false
+	}
+}
+
+// Deadline 返回进行中的回复必须结束的时间，只在开始排空后有意义
+func Deadline() time.Time {
+	mu.Lock()
+	defer mu.Unlock()
+	return deadline
+}
@@ -2,6 +2,8 @@ import { useState } from "react";
 
 import type { Route } from "./+types/home";
 import { Spinner } from "~/components/Spinner";
+import { readEvents } from "~/sse";
+import { authHeaders, setToken } from "~/token";
 
 export function meta({}: Route.MetaArgs) {
 	return [
@@ -83,6 +85,10 @@ export default function Home() {
 								setMessages([]);
 								return;
 							}
+							if (content === "/token" || content.startsWith("/token ")) {
+								setToken(content.slice(6).trim());
+								return;
+							}
 							setIsPending(true);
 							setMessages((prev) => [...prev, { content, fromUser: true }]);
 							const openaiMessages = messages
@@ -93,17 +99,22 @@ export default function Home() {
 								.concat({ role: "user", content });
 							const response = await fetch("/api/chat", {
 								method: "POST",
+								headers: authHeaders(),
 								body: JSON.stringify(openaiMessages),
 							});
-							const stream = response.body?.getReader();
-							if (!stream) return;
 							let finalMessage = "";
-							while (true) {
-								const { done, value } = await stream.read();
-								if (done) break;
-								const text = new TextDecoder().decode(value);
-								finalMessage += text;
-								setTempMessage((prev) => prev + text);
+							if (!response.ok) {
+								const body = await response.json().catch(() => null);
+								finalMessage = `[error: ${body?.error?.message ?? response.statusText}]`;
+							} else {
+								for await (const event of readEvents(response)) {
+									if (event.event === "delta") {
+										finalMessage += event.data.content;
+										setTempMessage((prev) => prev + event.data.content);
+									} else if (event.event === "error") {
+										finalMessage += `\n[error: ${event.data.message}]`;
+									}
+								}
 							}
 							setIsPending(false);
 							setTempMessage("");
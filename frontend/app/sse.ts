@@ -0,0 +1,42 @@
+export type ChatEvent =
+	| { event: "delta"; data: { content: string } }
+	| {
+			event: "usage";
+			data: {
+				prompt_tokens: number;
+				completion_tokens: number;
+				total_tokens: number;
+			};
+	  }
+	| { event: "error"; data: { message: string } }
+	| { event: "done"; data: { finish_reason: string } };
+
+// readEvents parses the text/event-stream body returned by /api/chat.
+export async function* readEvents(
+	response: Response,
+): AsyncGenerator<ChatEvent> {
+	const reader = response.body?.getReader();
+	if (!reader) return;
+	const decoder = new TextDecoder();
+	let buffer = "";
+	while (true) {
+		const { done, value } = await reader.read();
+		if (done) break;
+		buffer += decoder.decode(value, { stream: true });
+		let end = buffer.indexOf("\n\n");
+		while (end !== -1) {
+			const block = buffer.slice(0, end);
+			buffer = buffer.slice(end + 2);
+			end = buffer.indexOf("\n\n");
+			let event = "message";
+			let data = "";
+			for (const line of block.split("\n")) {
+				if (line.startsWith("event: ")) event = line.slice(7);
+				else if (line.startsWith("data: ")) data += line.slice(6);
+			}
+			if (data !== "") {
+				yield { event, data: JSON.parse(data) } as ChatEvent;
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+const storageKey = "sshtalk-token";
+
+// setToken stores the API token used for requests to the HTTP server.
+export function setToken(token: string) {
+	if (token === "") localStorage.removeItem(storageKey);
+	else localStorage.setItem(storageKey, token);
+}
+
+// authHeaders returns the Authorization header for the stored token, if any.
+export function authHeaders(): Record<string, string> {
+	const token = localStorage.getItem(storageKey);
+	return token ? { Authorization: `Bearer ${token}` } : {};
+}
@@ -0,0 +1,20 @@
+//go:build webui
+
+package frontend
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:build/client
+var files embed.FS
+
+// FS 返回嵌入的前端构建产物，需要先执行 pnpm build
+func FS() fs.FS {
+	client, err := fs.Sub(files, "build/client")
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
@@ -0,0 +1,10 @@
+//go:build !webui
+
+package frontend
+
+import "io/fs"
+
+// FS 在没有使用 webui 标签编译时返回 nil，HTTP 服务不提供网页界面
+func FS() fs.FS {
+	return nil
+}
@@ -4,7 +4,6 @@ import fs from "fs";
 
 export default {
 	// Config options...
-	// Server-side render by default, to enable SPA mode set this to `false`
-	ssr: true,
-	prerender: true,
+	// SPA mode: the Go server embeds build/client and serves index.html for every page
+	ssr: false,
 } satisfies Config;
@@ -0,0 +1,31 @@
+// Writes .gz and .br copies of the built client assets next to the originals,
+// so the Go server can serve precompressed files without compressing per request.
+import { readdirSync, readFileSync, statSync, writeFileSync } from "node:fs";
+import { join } from "node:path";
+import { brotliCompressSync, constants, gzipSync } from "node:zlib";
+
+const root = process.argv[2] ?? "build/client";
+const compressible = /\.(html|js|mjs|css|json|svg|txt|xml|ico|map|webmanifest)$/;
+const minSize = 1024;
+
+function walk(dir) {
+	for (const name of readdirSync(dir)) {
+		const path = join(dir, name);
+		if (statSync(path).isDirectory()) {
+			walk(path);
+			continue;
+		}
+		if (!compressible.test(name)) continue;
+		const data = readFileSync(path);
+		if (data.length < minSize) continue;
+		writeFileSync(`${path}.gz`, gzipSync(data, { level: 9 }));
+		writeFileSync(
+			`${path}.br`,
+			brotliCompressSync(data, {
+				params: { [constants.BROTLI_PARAM_QUALITY]: 11 },
+			}),
+		);
+	}
+}
+
+walk(root);
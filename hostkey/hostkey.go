@@ -0,0 +1,184 @@
+package hostkey
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/keygen"
+	gossh "golang.org/x/crypto/ssh"
+
+	"sshtalk/store"
+)
+
+// 没有配置 SSHTALK_HOST_KEY_TYPES 时生成的密钥类型
+var defaultTypes = []keygen.KeyType{keygen.Ed25519, keygen.RSA}
+
+// RSA 密钥长度，与 ssh-keygen 的默认值相同
+const rsaBits = 3072
+
+// 之前版本使用的主机密钥，相对于工作目录
+const legacyPath = ".ssh/id_ed25519"
+
+// Key 是一个主机密钥
+type Key struct {
+	Path   string
+	Signer gossh.Signer
+}
+
+// Dir 返回 SSHTALK_HOST_KEY_DIR 指定的主机密钥目录，默认为数据目录下的 host_keys
+func Dir() (string, error) {
+	if dir := os.Getenv("SSHTALK_HOST_KEY_DIR"); dir != "" {
+		return dir, nil
+	}
+	st, err := store.Default()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(st.Dir(), "host_keys"), nil
+}
+
+// Types 返回 SSHTALK_HOST_KEY_TYPES 配置的密钥类型，以逗号分隔，默认 ed25519,rsa
+func Types() ([]keygen.KeyType, error) {
+	v := os.Getenv("SSHTALK_HOST_KEY_TYPES")
+	if v == "" {
+		return defaultTypes, nil
+	}
+	var types []keygen.KeyType
+	for _, name := range strings.Split(v, ",") {
+		t := keygen.KeyType(strings.ToLower(strings.TrimSpace(name)))
+		switch t {
+		case keygen.Ed25519, keygen.RSA, keygen.ECDSA:
+		default:
+			return nil, fmt.Errorf("invalid SSHTALK_HOST_KEY_TYPES %q, expected ed25519, rsa or ecdsa", v)
+		}
+		if !slices.Contains(types, t) {
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+// Path 返回目录中某种类型的私钥文件，命名与 OpenSSH 相同
+func Path(dir string, t keygen.KeyType) string {
+	return filepath.Join(dir, fmt.Sprintf("ssh_host_%s_key", t))
+}
+
+// Ensure 生成目录中缺少的密钥，返回目录中所有的主机密钥。
+// 私钥文件权限为 0600，目录为 0700
+func Ensure(dir string, types []keygen.KeyType) ([]Key, error) {
+	for _, t := range types {
+		path := Path(dir, t)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if t == keygen.Ed25519 && migrate(path) {
+			continue
+		}
+		kp, err := keygen.New(path, keygen.WithKeyType(t), keygen.WithBitSize(rsaBits), keygen.WithWrite())
+		if err != nil {
+			return nil, fmt.Errorf("generate %s host key: %w", t, err)
+		}
+		slog.Info("generated SSH host key", "path", path, "fingerprint", gossh.FingerprintSHA256(kp.PublicKey()))
+	}
+	return Load(dir)
+}
+
+// migrate 把之前版本的主机密钥复制到新的位置，避免客户端看到主机密钥变化
+func migrate(path string) bool {
+	data, err := os.ReadFile(legacyPath)
+	if err != nil {
+		return false
+	}
+	if _, err := gossh.ParsePrivateKey(data); err != nil {
+		slog.Warn("ignoring legacy SSH host key", "path", legacyPath, "err", err)
+		return false
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		slog.Warn("failed to migrate legacy SSH host key", "path", legacyPath, "err", err)
+		return false
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		slog.Warn("failed to migrate legacy SSH host key", "path", legacyPath, "err", err)
+		return false
+	}
+	if pub, err := os.ReadFile(legacyPath + ".pub"); err == nil {
+		os.WriteFile(path+".pub", pub, 0o600)
+	}
+	slog.Info("migrated legacy SSH host key", "from", legacyPath, "to", path)
+	return true
+}
+
+// Load 读取目录中所有的 ssh_host_*_key 私钥，按文件名排序
+func Load(dir string) ([]Key, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "ssh_host_*_key"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		// 与 sshd 一样要求私钥只对所有者可读，权限过宽时收紧
+		if perm := info.Mode().Perm(); perm&0o077 != 0 {
+			slog.Warn("SSH host key is accessible by others, restricting to 0600", "path", path, "mode", fmt.Sprintf("%04o", perm))
+			if err := os.Chmod(path, 0o600); err != nil {
+				return nil, err
+			}
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := gossh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		keys = append(keys, Key{Path: path, Signer: signer})
+	}
+	return keys, nil
+}
+
+// Fingerprint 返回与 ssh-keygen -l 相同格式的指纹，如 256 SHA256:... (ED25519)
+func (k Key) Fingerprint() string {
+	pub := k.Signer.PublicKey()
+	return fmt.Sprintf("%d %s (%s)", bits(pub), gossh.FingerprintSHA256(pub), keyTypeName(pub))
+}
+
+func bits(pub gossh.PublicKey) int {
+	cpk, ok := pub.(gossh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch k := cpk.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		return 256
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	}
+	return 0
+}
+
+func keyTypeName(pub gossh.PublicKey) string {
+	switch pub.Type() {
+	case gossh.KeyAlgoED25519:
+		return "ED25519"
+	case gossh.KeyAlgoRSA:
+		return "RSA"
+	case gossh.KeyAlgoECDSA256, gossh.KeyAlgoECDSA384, gossh.KeyAlgoECDSA521:
+		return "ECDSA"
+	}
+	return strings.ToUpper(pub.Type())
+}
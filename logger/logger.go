@@ -0,0 +1,91 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup 按 SSHTALK_LOG_LEVEL（debug、info、warn、error，默认 info）和
+// SSHTALK_LOG_FORMAT（text 或 json，默认 text）配置默认的 slog 日志，
+// 标准库 log 的输出也会经过它
+func Setup() {
+	setup(os.Stderr, os.Getenv("SSHTALK_LOG_LEVEL"), os.Getenv("SSHTALK_LOG_FORMAT"))
+}
+
+func setup(w io.Writer, level, format string) {
+	var lvl slog.Level
+	badLevel := level != "" && lvl.UnmarshalText([]byte(level)) != nil
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		h = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+
+	if badLevel {
+		slog.Warn("unknown log level, using info", "level", level)
+	}
+	if format != "" && !strings.EqualFold(format, "json") && !strings.EqualFold(format, "text") {
+		slog.Warn("unknown log format, using text", "format", format)
+	}
+}
+
+type attrsKey struct{}
+
+// With 返回带有额外日志字段的 context，用这个 context 记录的日志都会带上这些字段
+func With(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev := Attrs(ctx)
+	all := make([]slog.Attr, 0, len(prev)+len(attrs))
+	all = append(append(all, prev...), attrs...)
+	return context.WithValue(ctx, attrsKey{}, all)
+}
+
+// Attrs 返回 context 中的日志字段
+func Attrs(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// NewID 生成用于关联日志的随机 ID，例如请求 ID 和会话 ID
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// contextHandler 把 context 中的字段和当前 span 的 trace_id、span_id 加到每条日志上
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(Attrs(ctx)...)
+	if ctx != nil {
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
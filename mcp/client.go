@@ -0,0 +1,310 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 使用的 MCP 协议版本
+const protocolVersion = "2024-11-05"
+
+// 关闭 stdin 后等待服务器进程退出的时间
+const closeTimeout = 5 * time.Second
+
+// Tool 是 MCP 服务器声明的一个工具
+type Tool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+// Resource 是 MCP 服务器声明的一个资源
+type Resource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	MimeType    string `json:"mimeType"`
+}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      *int64 `json:"id,omitempty"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("mcp error %d: %s", e.Code, e.Message)
+}
+
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// Client 通过 stdio 与单个 MCP 服务器进程通信
+type Client struct {
+	Name      string
+	Tools     []Tool
+	Resources []Resource
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	nextID atomic.Int64
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[int64]chan rpcMessage
+	closed  chan struct{}
+}
+
+// Start 启动 MCP 服务器进程，完成握手并获取工具和资源列表
+func Start(ctx context.Context, name string, cfg ServerConfig) (*Client, error) {
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range cfg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start mcp server %s: %w", name, err)
+	}
+
+	c := &Client{
+		Name:    name,
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[int64]chan rpcMessage),
+		closed:  make(chan struct{}),
+	}
+	go c.readLoop(stdout)
+
+	if err := c.initialize(ctx); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("initialize mcp server %s: %w", name, err)
+	}
+	return c, nil
+}
+
+func (c *Client) initialize(ctx context.Context) error {
+	var result struct {
+		Capabilities struct {
+			Tools     *struct{} `json:"tools"`
+			Resources *struct{} `json:"resources"`
+		} `json:"capabilities"`
+	}
+	err := c.call(ctx, "initialize", map[string]any{
+		"protocolVersion": protocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "sshtalk", "version": "1.0.0"},
+	}, &result)
+	if err != nil {
+		return err
+	}
+	if err := c.notify("notifications/initialized", nil); err != nil {
+		return err
+	}
+
+	if result.Capabilities.Tools != nil {
+		var tools struct {
+			Tools []Tool `json:"tools"`
+		}
+		if err := c.call(ctx, "tools/list", map[string]any{}, &tools); err != nil {
+			return err
+		}
+		c.Tools = tools.Tools
+	}
+	if result.Capabilities.Resources != nil {
+		var resources struct {
+			Resources []Resource `json:"resources"`
+		}
+		if err := c.call(ctx, "resources/list", map[string]any{}, &resources); err != nil {
+			return err
+		}
+		c.Resources = resources.Resources
+	}
+	return nil
+}
+
+// CallTool 调用工具，返回拼接后的文本结果
+func (c *Client) CallTool(ctx context.Context, name string, args map[string]any) (string, error) {
+	if args == nil {
+		args = map[string]any{}
+	}
+	var result struct {
+		Content []struct {
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			MimeType string `json:"mimeType"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+	if err := c.call(ctx, "tools/call", map[string]any{"name": name, "arguments": args}, &result); err != nil {
+		return "", err
+	}
+
+	var out string
+	for _, part := range result.Content {
+		if part.Type == "text" {
+			out += part.Text
+		} else {
+			out += fmt.Sprintf("[%s %s]", part.Type, part.MimeType)
+		}
+	}
+	if result.IsError {
+		return "", errors.New(out)
+	}
+	return out, nil
+}
+
+// ReadResource 读取资源的文本内容
+func (c *Client) ReadResource(ctx context.Context, uri string) (string, error) {
+	var result struct {
+		Contents []struct {
+			Text string `json:"text"`
+		} `json:"contents"`
+	}
+	if err := c.call(ctx, "resources/read", map[string]any{"uri": uri}, &result); err != nil {
+		return "", err
+	}
+	var out string
+	for _, part := range result.Contents {
+		out += part.Text
+	}
+	return out, nil
+}
+
+// Close 关闭 stdin 并等待服务器进程退出，closeTimeout 内没有退出时强制结束进程
+func (c *Client) Close() error {
+	c.stdin.Close()
+	select {
+	case <-c.closed:
+	case <-time.After(closeTimeout):
+		slog.Warn("mcp server did not exit, killing it", "server", c.Name)
+		c.cmd.Process.Kill()
+	}
+	return c.cmd.Wait()
+}
+
+func (c *Client) call(ctx context.Context, method string, params any, result any) error {
+	id := c.nextID.Add(1)
+	ch := make(chan rpcMessage, 1)
+
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(rpcRequest{JSONRPC: "2.0", ID: &id, Method: method, Params: params}); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closed:
+		return fmt.Errorf("mcp server %s exited", c.Name)
+	case msg := <-ch:
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Result, result)
+	}
+}
+
+func (c *Client) notify(method string, params any) error {
+	return c.write(rpcRequest{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (c *Client) write(req any) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// readLoop 读取服务器输出的每一行 JSON-RPC 消息
+func (c *Client) readLoop(r io.Reader) {
+	defer close(c.closed)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			slog.Warn("mcp invalid message", "server", c.Name, "err", err)
+			continue
+		}
+
+		if msg.Method != "" {
+			// 服务器发来的请求：只支持 ping，其余返回 method not found
+			if len(msg.ID) > 0 {
+				c.reply(msg)
+			}
+			continue
+		}
+
+		var id int64
+		if err := json.Unmarshal(msg.ID, &id); err != nil {
+			continue
+		}
+		// 取出后立即删除，服务器重复回复同一个 ID 时忽略后来的回复，不会阻塞读取
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+func (c *Client) reply(req rpcMessage) {
+	resp := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+	if req.Method == "ping" {
+		resp["result"] = map[string]any{}
+	} else {
+		resp["error"] = rpcError{Code: -32601, Message: "method not found"}
+	}
+	if err := c.write(resp); err != nil {
+		slog.Warn("mcp reply failed", "server", c.Name, "err", err)
+	}
+}
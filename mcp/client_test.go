@@ -0,0 +1,233 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 设置了这个环境变量时测试程序作为假的 MCP 服务器运行
+const fakeServerEnv = "SSHTALK_FAKE_MCP_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeServerEnv) != "" {
+		fakeServer()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeServer 从 stdin 读取请求，实现 initialize、tools/list、tools/call 和资源相关的方法，stdin 关闭时退出
+func fakeServer() {
+	scanner := bufio.NewScanner(os.Stdin)
+	out := json.NewEncoder(os.Stdout)
+	for scanner.Scan() {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params struct {
+				ProtocolVersion string         `json:"protocolVersion"`
+				Name            string         `json:"name"`
+				Arguments       map[string]any `json:"arguments"`
+				URI             string         `json:"uri"`
+			} `json:"params"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil || len(req.ID) == 0 {
+			// 通知不需要回复
+			continue
+		}
+
+		var result any
+		switch req.Method {
+		case "initialize":
+			result = map[string]any{
+				"protocolVersion": req.Params.ProtocolVersion,
+				"capabilities":    map[string]any{"tools": map[string]any{}, "resources": map[string]any{}},
+				"serverInfo":      map[string]any{"name": "fake", "version": "1.0.0"},
+			}
+		case "tools/list":
+			result = map[string]any{"tools": []map[string]any{
+				{
+					"name":        "echo",
+					"description": "Echo the text back",
+					"inputSchema": map[string]any{
+						"type":       "object",
+						"properties": map[string]any{"text": map[string]any{"type": "string"}},
+					},
+				},
+				{"name": "fail", "description": "Always fails"},
+			}}
+		case "tools/call":
+			switch req.Params.Name {
+			case "echo":
+				result = map[string]any{"content": []map[string]any{
+					{"type": "text", "text": fmt.Sprint(req.Params.Arguments["text"])},
+				}}
+			case "repeat":
+				// 有问题的服务器对同一个请求回复多次
+				result = map[string]any{"content": []map[string]any{{"type": "text", "text": "once"}}}
+				out.Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+				out.Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+			case "fail":
+				result = map[string]any{"isError": true, "content": []map[string]any{
+					{"type": "text", "text": "tool failed"},
+				}}
+			}
+		case "resources/list":
+			result = map[string]any{"resources": []map[string]any{
+				{"uri": "file:///readme", "name": "readme", "mimeType": "text/plain"},
+			}}
+		case "resources/read":
+			result = map[string]any{"contents": []map[string]any{
+				{"uri": req.Params.URI, "text": "contents of " + req.Params.URI},
+			}}
+		}
+
+		resp := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+		if result != nil {
+			resp["result"] = result
+		} else {
+			resp["error"] = map[string]any{"code": -32601, "message": "method not found"}
+		}
+		out.Encode(resp)
+	}
+}
+
+func fakeConfig() ServerConfig {
+	return ServerConfig{Command: os.Args[0], Env: map[string]string{fakeServerEnv: "1"}}
+}
+
+func startFake(t *testing.T) *Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := Start(ctx, "fake", fakeConfig())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return c
+}
+
+func TestClientInitialize(t *testing.T) {
+	c := startFake(t)
+	defer c.Close()
+
+	if len(c.Tools) != 2 || c.Tools[0].Name != "echo" || c.Tools[1].Name != "fail" {
+		t.Fatalf("tools = %+v, want echo and fail", c.Tools)
+	}
+	if c.Tools[0].InputSchema["type"] != "object" {
+		t.Errorf("echo input schema = %v", c.Tools[0].InputSchema)
+	}
+	if len(c.Resources) != 1 || c.Resources[0].URI != "file:///readme" {
+		t.Errorf("resources = %+v", c.Resources)
+	}
+}
+
+func TestClientCallTool(t *testing.T) {
+	c := startFake(t)
+	defer c.Close()
+	ctx := context.Background()
+
+	got, err := c.CallTool(ctx, "echo", map[string]any{"text": "hello"})
+	if err != nil || got != "hello" {
+		t.Errorf("CallTool(echo) = %q, %v, want hello", got, err)
+	}
+	if _, err := c.CallTool(ctx, "fail", nil); err == nil || err.Error() != "tool failed" {
+		t.Errorf("CallTool(fail) err = %v, want tool failed", err)
+	}
+	if _, err := c.CallTool(ctx, "missing", nil); err == nil || !strings.Contains(err.Error(), "method not found") {
+		t.Errorf("CallTool(missing) err = %v, want method not found", err)
+	}
+
+	// 重复的回复不能影响之后的调用
+	for i := 0; i < 3; i++ {
+		if got, err := c.CallTool(ctx, "repeat", nil); err != nil || got != "once" {
+			t.Fatalf("CallTool(repeat) = %q, %v, want once", got, err)
+		}
+	}
+	if got, err := c.CallTool(ctx, "echo", map[string]any{"text": "after"}); err != nil || got != "after" {
+		t.Errorf("CallTool(echo) after duplicate replies = %q, %v", got, err)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	c := startFake(t)
+	start := time.Now()
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// 服务器读到 stdin 结束就会退出，不应该等到超时后被强制结束
+	if d := time.Since(start); d >= closeTimeout {
+		t.Errorf("Close took %v", d)
+	}
+	if _, err := c.CallTool(context.Background(), "echo", nil); err == nil {
+		t.Error("CallTool after Close succeeded")
+	}
+}
+
+func TestManagerCall(t *testing.T) {
+	m := NewManager(context.Background(), Config{
+		MCPServers:  map[string]ServerConfig{"fake": fakeConfig()},
+		AutoApprove: []string{"fake__echo"},
+	})
+	defer m.Close()
+
+	var names []string
+	for _, tool := range m.OpenAITools() {
+		names = append(names, tool.Function.Name)
+	}
+	if want := "fake__echo fake__fail fake__read_resource"; strings.Join(names, " ") != want {
+		t.Errorf("tool names = %v, want %s", names, want)
+	}
+	if !m.AutoApproved("fake__echo") || m.AutoApproved("fake__fail") {
+		t.Error("AutoApproved does not match the config")
+	}
+
+	ctx := context.Background()
+	if got, err := m.Call(ctx, "fake__echo", `{"text":"hi"}`); err != nil || got != "hi" {
+		t.Errorf("Call(fake__echo) = %q, %v, want hi", got, err)
+	}
+	if got, err := m.Call(ctx, "fake__read_resource", `{"uri":"file:///readme"}`); err != nil || got != "contents of file:///readme" {
+		t.Errorf("Call(fake__read_resource) = %q, %v", got, err)
+	}
+	if _, err := m.Call(ctx, "other__echo", "{}"); err == nil {
+		t.Error("Call on an unknown server succeeded")
+	}
+	if _, err := m.Call(ctx, "fake__echo", "not json"); err == nil {
+		t.Error("Call with invalid arguments succeeded")
+	}
+}
+
+func TestLoadConfigServerNames(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"files", true},
+		{"my-server_2", true},
+		{"a__b", false},
+		{"a_", false},
+		{"_a", false},
+		{"my server", false},
+		{"files.v2", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "mcp.json")
+		cfg := Config{MCPServers: map[string]ServerConfig{tt.name: {Command: "true"}}}
+		data, _ := json.Marshal(cfg)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(path)
+		if (err == nil) != tt.ok {
+			t.Errorf("LoadConfig with server %q: err = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+}
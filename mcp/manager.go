@@ -0,0 +1,248 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go"
+	"go.opentelemetry.io/otel/attribute"
+
+	"sshtalk/tracing"
+)
+
+// 工具名中服务器名与工具名的分隔符
+const toolSep = "__"
+
+// 每个服务器都会额外暴露一个读取资源的工具
+const readResourceTool = "read_resource"
+
+// ServerConfig 描述一个 stdio MCP 服务器
+type ServerConfig struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env"`
+}
+
+// Config 与常见 MCP 客户端的配置文件格式兼容
+type Config struct {
+	MCPServers map[string]ServerConfig `json:"mcpServers"`
+	// 无需确认即可执行的工具（完整工具名，或 "*" 表示全部），HTTP 接口只会执行这些工具
+	AutoApprove []string `json:"autoApprove"`
+}
+
+// Manager 管理多个 MCP 服务器并把它们的工具暴露给模型
+type Manager struct {
+	clients     map[string]*Client
+	autoApprove map[string]bool
+	tools       []openai.ChatCompletionToolParam
+	routes      map[string]route // 暴露给模型的工具名对应的服务器和工具
+}
+
+// route 是一个暴露给模型的工具实际调用的服务器和工具，resource 表示读取资源的工具
+type route struct {
+	server   string
+	tool     string
+	resource bool
+}
+
+var (
+	shared     *Manager
+	sharedOnce sync.Once
+)
+
+// Shared 返回进程内共享的 Manager，首次调用时按 MCP_CONFIG 启动服务器
+func Shared() *Manager {
+	sharedOnce.Do(func() {
+		shared = newManager()
+		path := os.Getenv("MCP_CONFIG")
+		if path == "" {
+			return
+		}
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			slog.Error("failed to load MCP config", "path", path, "err", err)
+			return
+		}
+		shared = NewManager(context.Background(), cfg)
+	})
+	return shared
+}
+
+// LoadConfig 读取 JSON 配置文件
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	for name := range cfg.MCPServers {
+		if !validServerName(name) {
+			return cfg, fmt.Errorf("invalid MCP server name %q: use letters, digits, _ and -, without %q or a leading or trailing _", name, toolSep)
+		}
+	}
+	return cfg, nil
+}
+
+// validServerName 检查服务器名能否用在工具名中：工具名只能包含字母、数字、_ 和 -。
+// 服务器名中有分隔符或以 _ 开头、结尾时，工具名和其他服务器的工具名可能无法区分
+func validServerName(name string) bool {
+	if name == "" || strings.Contains(name, toolSep) || strings.HasPrefix(name, "_") || strings.HasSuffix(name, "_") {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func newManager() *Manager {
+	return &Manager{clients: map[string]*Client{}, autoApprove: map[string]bool{}, routes: map[string]route{}}
+}
+
+// NewManager 启动配置中的所有服务器，启动失败的服务器会被跳过
+func NewManager(ctx context.Context, cfg Config) *Manager {
+	m := newManager()
+	for _, name := range cfg.AutoApprove {
+		m.autoApprove[name] = true
+	}
+	for name, server := range cfg.MCPServers {
+		startCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		c, err := Start(startCtx, name, server)
+		cancel()
+		if err != nil {
+			slog.Error("failed to start MCP server", "server", name, "err", err)
+			continue
+		}
+		slog.Info("MCP server ready", "server", name, "tools", len(c.Tools), "resources", len(c.Resources))
+		m.clients[name] = c
+	}
+	m.index()
+	return m
+}
+
+// Close 同时关闭所有服务器，等待它们退出
+func (m *Manager) Close() {
+	var wg sync.WaitGroup
+	for name, c := range m.clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Close(); err != nil {
+				slog.Warn("MCP server exited with error", "server", name, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// CloseShared 关闭共享 Manager 启动的服务器，服务退出时调用。还没有启动过时不会再启动
+func CloseShared() {
+	sharedOnce.Do(func() {
+		shared = newManager()
+	})
+	shared.Close()
+}
+
+// AutoApproved 返回工具是否无需用户确认
+func (m *Manager) AutoApproved(toolName string) bool {
+	return m.autoApprove["*"] || m.autoApprove[toolName]
+}
+
+// OpenAITools 返回所有服务器的工具的 OpenAI 定义
+func (m *Manager) OpenAITools() []openai.ChatCompletionToolParam {
+	return m.tools
+}
+
+// index 生成暴露给模型的工具定义和工具名到服务器的映射。Call 按映射查找，不拆分工具名。
+// 服务器自己有 read_resource 工具时不再额外暴露读取资源的工具
+func (m *Manager) index() {
+	names := make([]string, 0, len(m.clients))
+	for name := range m.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	add := func(name string, r route, def openai.FunctionDefinitionParam) {
+		if other, ok := m.routes[name]; ok {
+			slog.Warn("duplicate MCP tool name, skipping", "tool", name, "server", r.server, "other", other.server)
+			return
+		}
+		m.routes[name] = r
+		m.tools = append(m.tools, openai.ChatCompletionToolParam{Function: def})
+	}
+	for _, name := range names {
+		c := m.clients[name]
+		for _, t := range c.Tools {
+			schema := t.InputSchema
+			if schema == nil {
+				schema = map[string]any{"type": "object", "properties": map[string]any{}}
+			}
+			add(name+toolSep+t.Name, route{server: name, tool: t.Name}, openai.FunctionDefinitionParam{
+				Name:        name + toolSep + t.Name,
+				Description: openai.String(t.Description),
+				Parameters:  openai.FunctionParameters(schema),
+			})
+		}
+		if len(c.Resources) > 0 {
+			var desc strings.Builder
+			fmt.Fprintf(&desc, "Read a resource from the %s MCP server. Available resources:", name)
+			for _, r := range c.Resources {
+				fmt.Fprintf(&desc, "\n- %s (%s) %s", r.URI, r.Name, r.Description)
+			}
+			add(name+toolSep+readResourceTool, route{server: name, resource: true}, openai.FunctionDefinitionParam{
+				Name:        name + toolSep + readResourceTool,
+				Description: openai.String(desc.String()),
+				Parameters: openai.FunctionParameters{
+					"type": "object",
+					"properties": map[string]any{
+						"uri": map[string]any{"type": "string", "description": "Resource URI"},
+					},
+					"required": []string{"uri"},
+				},
+			})
+		}
+	}
+}
+
+// Call 执行模型请求的工具调用，arguments 为模型给出的 JSON 字符串
+func (m *Manager) Call(ctx context.Context, toolName, arguments string) (content string, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "tool "+toolName)
+	span.SetAttributes(attribute.String("gen_ai.tool.name", toolName))
+	defer func() {
+		if err != nil {
+			tracing.RecordError(span, err)
+		}
+		span.End()
+	}()
+
+	r, ok := m.routes[toolName]
+	if !ok {
+		return "", fmt.Errorf("unknown tool %q", toolName)
+	}
+	c := m.clients[r.server]
+
+	var args map[string]any
+	if strings.TrimSpace(arguments) != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			return "", fmt.Errorf("invalid tool arguments: %w", err)
+		}
+	}
+
+	if r.resource {
+		uri, _ := args["uri"].(string)
+		return c.ReadResource(ctx, uri)
+	}
+	return c.CallTool(ctx, r.tool, args)
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 所有指标都以 sshtalk_ 开头，注册在默认的 Prometheus 注册表中
+var (
+	// HTTPRequests 按路由、方法和状态码统计 HTTP 请求
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sshtalk_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// HTTPDuration 是 HTTP 请求的处理时间，流式响应包含整个流的时间
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sshtalk_http_request_duration_seconds",
+		Help:    "HTTP request duration by route and method, including the whole stream for streaming responses.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 9),
+	}, []string{"route", "method"})
+
+	// SSHSessions 是当前连接的 SSH 会话数
+	SSHSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sshtalk_ssh_sessions_active",
+		Help: "SSH sessions currently connected.",
+	})
+
+	// SSHSessionsTotal 是累计的 SSH 会话数
+	SSHSessionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sshtalk_ssh_sessions_total",
+		Help: "SSH sessions started.",
+	})
+
+	// SSHSessionsRejected 按原因统计因连接数限制被拒绝的 SSH 会话
+	SSHSessionsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sshtalk_ssh_sessions_rejected_total",
+		Help: "SSH sessions rejected by a session limit, by limit: total, identity or ip.",
+	}, []string{"limit"})
+
+	// ActiveStreams 是正在进行的上游流式请求数
+	ActiveStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sshtalk_streams_active",
+		Help: "Upstream streaming completions in progress.",
+	})
+
+	// QueuedStreams 是等待空位的上游流式请求数
+	QueuedStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sshtalk_streams_queued",
+		Help: "Upstream streaming completions waiting for a free slot under SSHTALK_MAX_STREAMS.",
+	})
+
+	// TimeToFirstToken 是从发出请求到收到第一个内容块的时间
+	TimeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sshtalk_time_to_first_token_seconds",
+		Help:    "Time from sending a streaming request to receiving the first chunk, by model.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"model"})
+
+	// Tokens 按模型统计 token 用量，direction 为 in（提示）或 out（回复）
+	Tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sshtalk_tokens_total",
+		Help: "Tokens used by model, direction is in for prompt tokens and out for completion tokens.",
+	}, []string{"model", "direction"})
+
+	// UpstreamErrors 按状态码统计上游错误，网络错误的状态为 network
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sshtalk_upstream_errors_total",
+		Help: "Failed upstream model requests by HTTP status, or network when no response was received.",
+	}, []string{"status"})
+)
@@ -0,0 +1,203 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DenyRule 是拒绝列表中的一条规则，Keywords 不区分大小写按整词匹配，Pattern 是正则表达式。
+// Action 默认为 block，Stage 为空时同时检查用户消息和回复
+type DenyRule struct {
+	Keywords []string `json:"keywords,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Action   Action   `json:"action,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+	Stage    Stage    `json:"stage,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Denylist 按关键词和正则表达式检查文本
+type Denylist struct {
+	rules []DenyRule
+}
+
+// LoadDenylist 从 JSON 文件读取规则：
+// [{"keywords": ["..."], "pattern": "...", "action": "block", "reason": "...", "stage": "input"}]
+func LoadDenylist(path string) (*Denylist, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []DenyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return NewDenylist(rules)
+}
+
+// NewDenylist 编译规则
+func NewDenylist(rules []DenyRule) (*Denylist, error) {
+	d := &Denylist{rules: rules}
+	for i := range d.rules {
+		rule := &d.rules[i]
+		switch rule.Action {
+		case "":
+			rule.Action = ActionBlock
+		case ActionBlock, ActionAnnotate:
+		default:
+			return nil, fmt.Errorf("denylist rule %d: unknown action %q, expected block or annotate", i+1, rule.Action)
+		}
+		switch rule.Stage {
+		case "", StageInput, StageOutput:
+		default:
+			return nil, fmt.Errorf("denylist rule %d: unknown stage %q, expected input or output", i+1, rule.Stage)
+		}
+
+		var alts []string
+		for _, k := range rule.Keywords {
+			if k = strings.TrimSpace(k); k != "" {
+				alts = append(alts, `\b`+regexp.QuoteMeta(k)+`\b`)
+			}
+		}
+		pattern := rule.Pattern
+		if len(alts) > 0 {
+			keywords := `(?i)(?:` + strings.Join(alts, "|") + `)`
+			if pattern != "" {
+				pattern = keywords + `|(?:` + pattern + `)`
+			} else {
+				pattern = keywords
+			}
+		}
+		if pattern == "" {
+			return nil, fmt.Errorf("denylist rule %d needs keywords or a pattern", i+1)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("denylist rule %d: %w", i+1, err)
+		}
+		rule.re = re
+	}
+	return d, nil
+}
+
+func (d *Denylist) local() {}
+
+func (d *Denylist) Name() string {
+	return "denylist"
+}
+
+// Check 返回第一条匹配的 block 规则，没有时返回第一条匹配的 annotate 规则
+func (d *Denylist) Check(ctx context.Context, req Request) (Decision, error) {
+	decision := Decision{Action: ActionAllow}
+	for _, rule := range d.rules {
+		if rule.Stage != "" && rule.Stage != req.Stage || !rule.re.MatchString(req.Text) {
+			continue
+		}
+		if rule.Action == ActionBlock {
+			return Decision{Action: ActionBlock, Reason: rule.Reason}, nil
+		}
+		if decision.Action == ActionAllow {
+			decision = Decision{Action: rule.Action, Reason: rule.Reason}
+		}
+	}
+	return decision, nil
+}
+
+// Command 把请求的 JSON 写入外部命令的标准输入，从标准输出读取决定。
+// 命令由 sh -c 执行，没有输出时放行，退出码不为 0 时视为出错
+type Command struct {
+	Cmd     string
+	Timeout time.Duration
+}
+
+func (c *Command) Name() string {
+	return "command"
+}
+
+func (c *Command) Check(ctx context.Context, req Request) (Decision, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	in, err := json.Marshal(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.Cmd)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return Decision{}, fmt.Errorf("%w: %s", err, msg)
+		}
+		return Decision{}, err
+	}
+	return parseDecision(stdout.Bytes())
+}
+
+// HTTP 把请求的 JSON POST 到审核接口，从响应体读取决定，状态码不是 2xx 时视为出错
+type HTTP struct {
+	URL     string
+	Timeout time.Duration
+}
+
+func (h *HTTP) Name() string {
+	return "http"
+}
+
+func (h *HTTP) Check(ctx context.Context, req Request) (Decision, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return Decision{}, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return Decision{}, fmt.Errorf("moderation endpoint returned %s", res.Status)
+	}
+	return parseDecision(data)
+}
+
+// parseDecision 解析外部钩子返回的决定，空输出视为放行。动作不区分大小写，
+// 无法识别的动作作为钩子出错处理，由 SSHTALK_MODERATION_ON_ERROR 决定是否放行
+func parseDecision(data []byte) (Decision, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return Decision{Action: ActionAllow}, nil
+	}
+	var d Decision
+	if err := json.Unmarshal(data, &d); err != nil {
+		return Decision{}, fmt.Errorf("invalid moderation decision: %w", err)
+	}
+	d.Action = Action(strings.ToLower(strings.TrimSpace(string(d.Action))))
+	if !d.Action.valid() {
+		return Decision{}, fmt.Errorf("invalid moderation decision: unknown action %q", d.Action)
+	}
+	return d, nil
+}
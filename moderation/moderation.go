@@ -0,0 +1,287 @@
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"sshtalk/audit"
+)
+
+// Stage 是检查的位置：发往模型之前的用户消息，或模型生成的回复
+type Stage string
+
+const (
+	StageInput  Stage = "input"
+	StageOutput Stage = "output"
+)
+
+// Action 是钩子对一段文本的决定
+type Action string
+
+const (
+	ActionAllow    Action = "allow"    // 放行
+	ActionBlock    Action = "block"    // 拒绝，整轮对话结束
+	ActionAnnotate Action = "annotate" // 放行，同时把 Reason 作为提示展示给用户
+)
+
+// valid 判断是否是已知的动作，空值视为 allow
+func (a Action) valid() bool {
+	switch a {
+	case "", ActionAllow, ActionBlock, ActionAnnotate:
+		return true
+	}
+	return false
+}
+
+// 外部钩子的默认超时
+const defaultTimeout = 5 * time.Second
+
+// 流式回复每积累这么多字节用所有钩子检查一次，结束时再检查完整的回复。
+// 本地的钩子开销很小，每个增量都检查
+const outputCheckBytes = 512
+
+// Request 是交给钩子检查的内容，外部命令和 HTTP 接口收到的是它的 JSON
+type Request struct {
+	Stage    Stage  `json:"stage"`
+	Text     string `json:"text"`
+	Source   string `json:"source,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	User     string `json:"user,omitempty"`
+}
+
+// Decision 是钩子的决定，Action 为空时视为 allow
+type Decision struct {
+	Action Action `json:"action"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Hook 是一个审核钩子
+type Hook interface {
+	Name() string
+	Check(ctx context.Context, req Request) (Decision, error)
+}
+
+// local 由不访问外部服务的钩子实现，流式回复的每个增量都用它们检查
+type local interface {
+	local()
+}
+
+// BlockedError 表示内容被审核钩子拒绝
+type BlockedError struct {
+	Stage  Stage
+	Hook   string
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	what := "message"
+	if e.Stage == StageOutput {
+		what = "response"
+	}
+	if e.Reason == "" {
+		return what + " blocked by usage policy"
+	}
+	return what + " blocked by usage policy: " + e.Reason
+}
+
+// Blocked 让审计日志把这一轮记录为 blocked
+func (e *BlockedError) Blocked() bool {
+	return true
+}
+
+// Moderator 按顺序执行钩子，第一个 block 生效，annotate 的提示全部保留
+type Moderator struct {
+	hooks []Hook
+	local []Hook // hooks 中实现了 local 的部分
+	// 钩子出错时是否放行，默认拒绝
+	failOpen bool
+}
+
+var (
+	defaultModerator    *Moderator
+	defaultModeratorErr error
+	defaultOnce         sync.Once
+)
+
+// Default 返回按环境变量配置的 Moderator，没有配置任何钩子时返回 nil（不检查）：
+// SSHTALK_MODERATION_DENYLIST 是关键词和正则规则的 JSON 文件；
+// SSHTALK_MODERATION_COMMAND 是外部命令，从标准输入读取请求，向标准输出写出决定；
+// SSHTALK_MODERATION_URL 是接收 POST 请求的审核接口；
+// SSHTALK_MODERATION_TIMEOUT 是外部钩子的超时，默认 5s；
+// SSHTALK_MODERATION_ON_ERROR 为 block（默认）或 allow，决定钩子出错时的处理
+func Default() (*Moderator, error) {
+	defaultOnce.Do(func() {
+		defaultModerator, defaultModeratorErr = fromEnv()
+	})
+	return defaultModerator, defaultModeratorErr
+}
+
+func fromEnv() (*Moderator, error) {
+	timeout := defaultTimeout
+	if v := os.Getenv("SSHTALK_MODERATION_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid SSHTALK_MODERATION_TIMEOUT %q", v)
+		}
+		timeout = d
+	}
+
+	var hooks []Hook
+	if path := os.Getenv("SSHTALK_MODERATION_DENYLIST"); path != "" {
+		d, err := LoadDenylist(path)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, d)
+	}
+	if cmd := os.Getenv("SSHTALK_MODERATION_COMMAND"); cmd != "" {
+		hooks = append(hooks, &Command{Cmd: cmd, Timeout: timeout})
+	}
+	if url := os.Getenv("SSHTALK_MODERATION_URL"); url != "" {
+		hooks = append(hooks, &HTTP{URL: url, Timeout: timeout})
+	}
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+
+	m := New(hooks...)
+	switch v := strings.ToLower(os.Getenv("SSHTALK_MODERATION_ON_ERROR")); v {
+	case "", "block":
+	case "allow":
+		m.failOpen = true
+	default:
+		return nil, fmt.Errorf("invalid SSHTALK_MODERATION_ON_ERROR %q, expected block or allow", v)
+	}
+	return m, nil
+}
+
+// New 创建按顺序执行 hooks 的 Moderator，钩子出错时拒绝
+func New(hooks ...Hook) *Moderator {
+	m := &Moderator{hooks: hooks}
+	for _, h := range hooks {
+		if _, ok := h.(local); ok {
+			m.local = append(m.local, h)
+		}
+	}
+	return m
+}
+
+// Check 检查一段文本。被拒绝时返回 *BlockedError，否则返回 annotate 的提示。
+// m 为 nil 时不做任何检查
+func (m *Moderator) Check(ctx context.Context, stage Stage, text string) ([]string, error) {
+	if m == nil || text == "" {
+		return nil, nil
+	}
+	return m.run(ctx, m.hooks, stage, text, nil)
+}
+
+// run 按顺序执行 hooks，seen 中已有的提示不再记录日志
+func (m *Moderator) run(ctx context.Context, hooks []Hook, stage Stage, text string, seen []string) ([]string, error) {
+	req := Request{Stage: stage, Text: text}
+	if a, ok := audit.ActorFrom(ctx); ok {
+		req.Source = a.Source
+		req.Identity = a.Identity
+		req.User = a.User
+	}
+
+	var notes []string
+	for _, h := range hooks {
+		d, err := h.Check(ctx, req)
+		if err == nil && !d.Action.valid() {
+			err = fmt.Errorf("unknown action %q", d.Action)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return notes, ctx.Err()
+			}
+			slog.ErrorContext(ctx, "moderation hook failed", "hook", h.Name(), "stage", string(stage), "err", err)
+			if m.failOpen {
+				continue
+			}
+			d = Decision{Action: ActionBlock, Reason: "the policy check is unavailable"}
+		}
+
+		switch d.Action {
+		case "", ActionAllow:
+		case ActionBlock:
+			slog.InfoContext(ctx, "blocked by moderation", "hook", h.Name(), "stage", string(stage), "reason", d.Reason)
+			trace.SpanFromContext(ctx).AddEvent("moderation.blocked", trace.WithAttributes(
+				attribute.String("sshtalk.moderation.hook", h.Name()),
+				attribute.String("sshtalk.moderation.stage", string(stage)),
+			))
+			return notes, &BlockedError{Stage: stage, Hook: h.Name(), Reason: d.Reason}
+		case ActionAnnotate:
+			if !slices.Contains(seen, d.Reason) {
+				slog.InfoContext(ctx, "annotated by moderation", "hook", h.Name(), "stage", string(stage), "reason", d.Reason)
+			}
+			if d.Reason != "" {
+				notes = append(notes, d.Reason)
+			}
+		}
+	}
+	return notes, nil
+}
+
+// Output 检查流式生成的回复。每次检查的都是到目前为止的完整回复，
+// 跨越多个块的关键词也能发现
+type Output struct {
+	m       *Moderator
+	ctx     context.Context
+	text    strings.Builder
+	checked int // 上次检查时的长度
+	notes   []string
+}
+
+// Output 开始检查一条流式回复，m 为 nil 时返回的 Output 什么也不做
+func (m *Moderator) Output(ctx context.Context) *Output {
+	return &Output{m: m, ctx: ctx}
+}
+
+// Write 追加一段增量内容，用本地钩子检查，新内容足够多时用所有钩子检查
+func (o *Output) Write(delta string) error {
+	if o.m == nil || delta == "" {
+		return nil
+	}
+	o.text.WriteString(delta)
+	if o.text.Len()-o.checked < outputCheckBytes {
+		if len(o.m.local) == 0 {
+			return nil
+		}
+		return o.check(o.m.local)
+	}
+	o.checked = o.text.Len()
+	return o.check(o.m.hooks)
+}
+
+// Close 检查完整的回复
+func (o *Output) Close() error {
+	if o.m == nil || o.text.Len() == o.checked {
+		return nil
+	}
+	o.checked = o.text.Len()
+	return o.check(o.m.hooks)
+}
+
+// Notes 返回 annotate 的提示，重复的提示只保留一次
+func (o *Output) Notes() []string {
+	return o.notes
+}
+
+func (o *Output) check(hooks []Hook) error {
+	notes, err := o.m.run(o.ctx, hooks, StageOutput, o.text.String(), o.notes)
+	for _, n := range notes {
+		if !slices.Contains(o.notes, n) {
+			o.notes = append(o.notes, n)
+		}
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package motd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"sshtalk/store"
+)
+
+// 没有配置 SSHTALK_MOTD_FILE 时的欢迎消息
+const defaultMOTD = `Welcome to sshtalk{{with .User}}, {{.}}{{end}}!
+Type a message and press Enter to send.{{with .Announcement}}
+
+{{.}}{{end}}`
+
+// Data 是横幅和欢迎消息模板可以使用的字段
+type Data struct {
+	User         string // SSH 用户名，网页终端中为令牌名
+	Identity     string // 公钥指纹等身份，横幅显示在认证之前，此时为空
+	Model        string // 默认模型
+	Announcement string // 管理员发布的公告，渲染时自动填入
+}
+
+// Banner 返回 SSHTALK_BANNER_FILE 模板渲染的横幅，SSH 客户端在认证前显示。没有配置时为空
+func Banner(data Data) string {
+	path := os.Getenv("SSHTALK_BANNER_FILE")
+	if path == "" {
+		return ""
+	}
+	text, err := renderFile(path, data)
+	if err != nil {
+		slog.Error("failed to render SSH banner", "path", path, "err", err)
+		return ""
+	}
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text
+}
+
+// MOTD 返回登录后显示的欢迎消息，模板由 SSHTALK_MOTD_FILE 指定。
+// 模板在每个会话开始时重新读取，修改后不需要重启
+func MOTD(data Data) string {
+	path := os.Getenv("SSHTALK_MOTD_FILE")
+	if path != "" {
+		text, err := renderFile(path, data)
+		if err == nil {
+			return text
+		}
+		slog.Error("failed to render MOTD, using the default", "path", path, "err", err)
+	}
+	text, _ := render(template.Must(template.New("motd").Parse(defaultMOTD)), data)
+	return text
+}
+
+// Validate 检查配置的模板能否解析，服务启动时调用
+func Validate() error {
+	for _, name := range []string{"SSHTALK_BANNER_FILE", "SSHTALK_MOTD_FILE"} {
+		if path := os.Getenv(name); path != "" {
+			if _, err := parseFile(path); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseFile(path string) (*template.Template, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(filepath.Base(path)).Parse(string(src))
+}
+
+func renderFile(path string, data Data) (string, error) {
+	t, err := parseFile(path)
+	if err != nil {
+		return "", err
+	}
+	return render(t, data)
+}
+
+func render(t *template.Template, data Data) (string, error) {
+	announcement, err := Announcement()
+	if err != nil {
+		slog.Warn("failed to read announcement", "err", err)
+	}
+	data.Announcement = announcement
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(buf.String(), "\n"), nil
+}
+
+// AnnouncementPath 返回公告文件，SSHTALK_ANNOUNCEMENT_FILE 指定，默认为数据目录下的 announcement.txt
+func AnnouncementPath() (string, error) {
+	if path := os.Getenv("SSHTALK_ANNOUNCEMENT_FILE"); path != "" {
+		return path, nil
+	}
+	st, err := store.Default()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(st.Dir(), "announcement.txt"), nil
+}
+
+// Announcement 返回当前的公告，没有公告时为空
+func Announcement() (string, error) {
+	path, err := AnnouncementPath()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SetAnnouncement 发布公告，之后开始的会话都会看到；text 为空时清除公告
+func SetAnnouncement(text string) error {
+	path, err := AnnouncementPath()
+	if err != nil {
+		return err
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return store.WriteFileAtomic(path, []byte(text+"\n"), 0o644)
+}
@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/openai/openai-go/packages/ssestream"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"sshtalk/moderation"
+	"sshtalk/tracing"
+)
+
+// SystemPrompt 是私聊会话的系统提示，SSH、网页终端和 /api/ws 使用同一个
+const SystemPrompt = `Do not use markdown except when user asks for it.`
+
+// Provider 是所有模型请求的统一出口，TUI、聊天室和 HTTP 接口都通过它访问上游
+type Provider struct {
+	client openai.Client
+	// Model 是请求未指定模型时使用的默认模型
+	Model string
+}
+
+var (
+	defaultProvider *Provider
+	defaultOnce     sync.Once
+)
+
+// Default 返回按 OPENAI_BASE_URL、OPENAI_API_KEY、OPENAI_MODEL 配置的 Provider
+func Default() *Provider {
+	defaultOnce.Do(func() {
+		defaultProvider = New(os.Getenv("OPENAI_BASE_URL"), os.Getenv("OPENAI_API_KEY"), os.Getenv("OPENAI_MODEL"))
+	})
+	return defaultProvider
+}
+
+// New 创建一个 Provider
+func New(baseURL, apiKey, model string) *Provider {
+	return &Provider{
+		client: openai.NewClient(option.WithBaseURL(baseURL), option.WithAPIKey(apiKey)),
+		Model:  model,
+	}
+}
+
+// NewStreaming 发起流式请求，params.Model 为空时使用默认模型。
+// 同时进行的流式请求达到 SSHTALK_MAX_STREAMS 时先排队，排队时 ctx 被取消则返回出错的流
+func (p *Provider) NewStreaming(ctx context.Context, params openai.ChatCompletionNewParams, opts ...option.RequestOption) *Stream {
+	if params.Model == "" {
+		params.Model = p.Model
+	}
+	ctx, span := startRequest(ctx, params, true)
+	q := streams()
+	queued := time.Now()
+	if err := q.acquire(ctx); err != nil {
+		return newStream(ctx, span, ssestream.NewStream[openai.ChatCompletionChunk](nil, err), params.Model, queued, nil)
+	}
+	// 排队时间不计入首个 token 时间
+	span.SetAttributes(attribute.Int64("sshtalk.queue_ms", time.Since(queued).Milliseconds()))
+	start := time.Now()
+	return newStream(ctx, span, p.client.Chat.Completions.NewStreaming(ctx, params, opts...), params.Model, start, q.release)
+}
+
+// New 发起非流式请求，params.Model 为空时使用默认模型。
+// 回复被审核钩子拒绝时返回 *moderation.BlockedError
+func (p *Provider) New(ctx context.Context, params openai.ChatCompletionNewParams, opts ...option.RequestOption) (*openai.ChatCompletion, error) {
+	if params.Model == "" {
+		params.Model = p.Model
+	}
+	ctx, span := startRequest(ctx, params, false)
+	start := time.Now()
+	res, err := p.client.Chat.Completions.New(ctx, params, opts...)
+	if err != nil {
+		endRequest(ctx, span, params.Model, start, openai.CompletionUsage{}, err)
+		return nil, err
+	}
+	model := res.Model
+	if model == "" {
+		model = params.Model
+	}
+	recordUsage(model, res.Usage)
+	if len(res.Choices) > 0 {
+		m, _ := moderation.Default()
+		if _, err := m.Check(ctx, moderation.StageOutput, res.Choices[0].Message.Content); err != nil {
+			endRequest(ctx, span, model, start, res.Usage, err)
+			return nil, err
+		}
+	}
+	endRequest(ctx, span, model, start, res.Usage, nil)
+	return res, nil
+}
+
+// startRequest 为上游请求创建 span 并记录日志，返回的 context 用于发出请求
+func startRequest(ctx context.Context, params openai.ChatCompletionNewParams, stream bool) (context.Context, trace.Span) {
+	ctx, span := tracing.Tracer().Start(ctx, "chat "+params.Model,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("gen_ai.system", "openai"),
+			attribute.String("gen_ai.operation.name", "chat"),
+			attribute.String("gen_ai.request.model", params.Model),
+			attribute.Bool("sshtalk.stream", stream),
+		),
+	)
+	slog.DebugContext(ctx, "upstream request", "model", params.Model, "messages", len(params.Messages), "stream", stream)
+	return ctx, span
+}
+
+// Models 返回上游提供的模型列表
+func (p *Provider) Models(ctx context.Context) ([]openai.Model, error) {
+	page, err := p.client.Models.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return page.Data, nil
+}
@@ -0,0 +1,138 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"sshtalk/metrics"
+)
+
+// queue 限制同时进行的上游流式请求数，超过上限的请求按先来后到排队
+type queue struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiters []*waiter
+}
+
+type waiter struct {
+	ready  chan struct{}
+	notify func(int)
+}
+
+var (
+	streamQueue *queue
+	queueOnce   sync.Once
+)
+
+// StreamLimit 返回 SSHTALK_MAX_STREAMS 配置的同时进行的流式请求上限，0 表示不限制
+func StreamLimit() (int, error) {
+	v := os.Getenv("SSHTALK_MAX_STREAMS")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid SSHTALK_MAX_STREAMS %q", v)
+	}
+	return n, nil
+}
+
+func streams() *queue {
+	queueOnce.Do(func() {
+		// 配置在服务启动时已经检查过
+		limit, _ := StreamLimit()
+		streamQueue = &queue{limit: limit}
+	})
+	return streamQueue
+}
+
+type queueNotifyKey struct{}
+
+// WithQueueNotify 返回的 context 发起的流式请求需要排队时，notify 收到请求在队列中的位置，从 1 开始，
+// 轮到请求时收到 0。notify 在队列的锁内调用，不能阻塞，请求开始后不会再被调用
+func WithQueueNotify(ctx context.Context, notify func(pos int)) context.Context {
+	return context.WithValue(ctx, queueNotifyKey{}, notify)
+}
+
+// acquire 等待一个空位，ctx 取消时放弃排队
+func (q *queue) acquire(ctx context.Context) error {
+	if q.limit == 0 {
+		return nil
+	}
+	q.mu.Lock()
+	if q.active < q.limit && len(q.waiters) == 0 {
+		q.active++
+		q.mu.Unlock()
+		return nil
+	}
+	notify, _ := ctx.Value(queueNotifyKey{}).(func(int))
+	w := &waiter{ready: make(chan struct{}), notify: notify}
+	q.waiters = append(q.waiters, w)
+	metrics.QueuedStreams.Inc()
+	if notify != nil {
+		notify(len(q.waiters))
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-w.ready:
+		// 取消的同时轮到了这个请求，把空位让给下一个
+		q.releaseLocked()
+	default:
+		for i, other := range q.waiters {
+			if other == w {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				break
+			}
+		}
+		metrics.QueuedStreams.Dec()
+		q.notifyLocked()
+	}
+	return ctx.Err()
+}
+
+// release 释放空位，有请求在排队时直接交给队首的请求
+func (q *queue) release() {
+	if q.limit == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked()
+}
+
+func (q *queue) releaseLocked() {
+	if len(q.waiters) == 0 {
+		q.active--
+		return
+	}
+	w := q.waiters[0]
+	q.waiters = q.waiters[1:]
+	metrics.QueuedStreams.Dec()
+	if w.notify != nil {
+		w.notify(0)
+	}
+	close(w.ready)
+	q.notifyLocked()
+}
+
+// notifyLocked 通知排队的请求新的位置
+func (q *queue) notifyLocked() {
+	for i, w := range q.waiters {
+		if w.notify != nil {
+			w.notify(i + 1)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/packages/ssestream"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"sshtalk/metrics"
+	"sshtalk/moderation"
+	"sshtalk/tracing"
+)
+
+// Stream 包装上游的流式响应，记录首个 token 时间、token 用量和错误，
+// 同时把生成的内容交给审核钩子，被拒绝时流提前结束，Err 返回 *moderation.BlockedError。
+// Next 和 Close 可以在不同的 goroutine 中调用，Close 会让阻塞的 Next 返回
+type Stream struct {
+	ctx    context.Context
+	span   trace.Span
+	stream *ssestream.Stream[openai.ChatCompletionChunk]
+	start  time.Time
+	output *moderation.Output
+	// release 在流结束时释放占用的空位
+	release func()
+	// stop 取消 ctx 结束时自动结束流的回调
+	stop func() bool
+
+	gotFirst bool
+
+	mu       sync.Mutex
+	model    string
+	usage    openai.CompletionUsage
+	err      error // 审核拒绝等不来自上游的错误
+	finished bool
+}
+
+// start 是发出请求的时间，包括 SDK 重试在内的等待都计入首个 token 时间。
+// 调用者没有读完也没有关闭流时，ctx 结束后流也会结束并释放空位
+func newStream(ctx context.Context, span trace.Span, stream *ssestream.Stream[openai.ChatCompletionChunk], model string, start time.Time, release func()) *Stream {
+	metrics.ActiveStreams.Inc()
+	m, _ := moderation.Default()
+	s := &Stream{ctx: ctx, span: span, stream: stream, model: model, start: start, output: m.Output(ctx), release: release}
+	s.stop = context.AfterFunc(ctx, func() { s.finish(ctx.Err()) })
+	return s
+}
+
+// Next 读取下一个块，流结束或出错时返回 false
+func (s *Stream) Next() bool {
+	if s.isFinished() {
+		return false
+	}
+	if !s.stream.Next() {
+		err := s.stream.Err()
+		if err == nil {
+			err = s.output.Close()
+			s.setErr(err)
+		}
+		s.finish(err)
+		return false
+	}
+	chunk := s.stream.Current()
+	// 被拒绝的块不交给调用者
+	if len(chunk.Choices) > 0 {
+		if err := s.output.Write(chunk.Choices[0].Delta.Content); err != nil {
+			s.setErr(err)
+			s.finish(err)
+			s.stream.Close()
+			return false
+		}
+	}
+
+	s.mu.Lock()
+	if chunk.Model != "" {
+		s.model = chunk.Model
+	}
+	model := s.model
+	if chunk.Usage.TotalTokens > 0 {
+		s.usage = chunk.Usage
+	}
+	s.mu.Unlock()
+
+	if !s.gotFirst {
+		s.gotFirst = true
+		ttft := time.Since(s.start)
+		metrics.TimeToFirstToken.WithLabelValues(model).Observe(ttft.Seconds())
+		s.span.AddEvent("first_token", trace.WithAttributes(attribute.Int64("sshtalk.time_to_first_token_ms", ttft.Milliseconds())))
+	}
+	if chunk.Usage.TotalTokens > 0 {
+		recordUsage(model, chunk.Usage)
+	}
+	return true
+}
+
+// Current 返回当前的块
+func (s *Stream) Current() openai.ChatCompletionChunk {
+	return s.stream.Current()
+}
+
+// Err 返回流的错误
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.stream.Err()
+}
+
+func (s *Stream) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *Stream) isFinished() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.finished
+}
+
+// Notes 返回审核钩子对已生成内容的提示
+func (s *Stream) Notes() []string {
+	return s.output.Notes()
+}
+
+// Close 提前结束流，按取消记录，之后 Err 返回 context.Canceled
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if !s.finished && s.err == nil {
+		s.err = context.Canceled
+	}
+	s.mu.Unlock()
+	s.finish(context.Canceled)
+	return s.stream.Close()
+}
+
+// finish 结束流并释放空位，只有第一次调用有效，err 是记录的结果
+func (s *Stream) finish(err error) {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	model, usage := s.model, s.usage
+	s.mu.Unlock()
+
+	s.stop()
+	metrics.ActiveStreams.Dec()
+	if s.release != nil {
+		s.release()
+	}
+	endRequest(s.ctx, s.span, model, s.start, usage, err)
+}
+
+func recordUsage(model string, usage openai.CompletionUsage) {
+	metrics.Tokens.WithLabelValues(model, "in").Add(float64(usage.PromptTokens))
+	metrics.Tokens.WithLabelValues(model, "out").Add(float64(usage.CompletionTokens))
+}
+
+// endRequest 记录一次上游请求的结果并结束 span，失败时同时计入错误指标
+func endRequest(ctx context.Context, span trace.Span, model string, start time.Time, usage openai.CompletionUsage, err error) {
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("gen_ai.response.model", model),
+		attribute.Int64("gen_ai.usage.input_tokens", usage.PromptTokens),
+		attribute.Int64("gen_ai.usage.output_tokens", usage.CompletionTokens),
+	)
+
+	duration := time.Since(start).Milliseconds()
+	switch {
+	case err == nil:
+		slog.DebugContext(ctx, "upstream response", "model", model, "duration_ms", duration,
+			"prompt_tokens", usage.PromptTokens, "completion_tokens", usage.CompletionTokens)
+	case errors.Is(err, context.Canceled):
+		span.AddEvent("cancelled")
+		slog.DebugContext(ctx, "upstream request cancelled", "model", model, "duration_ms", duration)
+	case errors.As(err, new(*moderation.BlockedError)):
+		// 上游请求本身成功，拒绝原因已由审核记录
+		slog.DebugContext(ctx, "upstream response blocked", "model", model, "duration_ms", duration)
+	default:
+		recordError(err)
+		tracing.RecordError(span, err)
+		slog.WarnContext(ctx, "upstream request failed", "model", model, "duration_ms", duration, "err", err)
+	}
+}
+
+// recordError 按上游返回的状态码记录错误
+func recordError(err error) {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		metrics.UpstreamErrors.WithLabelValues(strconv.Itoa(apiErr.StatusCode)).Inc()
+		return
+	}
+	metrics.UpstreamErrors.WithLabelValues("network").Inc()
+}
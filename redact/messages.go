@@ -0,0 +1,92 @@
+package redact
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/openai/openai-go"
+)
+
+// CheckMessages 检查即将发往模型的完整聊天历史：用户、助手和工具消息的文本都按处理方式检查，
+// 系统提示由管理员配置，不检查。返回的是副本，不修改传入的消息。
+// 载入的对话可能来自导入或 HTTP 接口，没有经过输入时的检查，所以每次请求都检查全部历史
+func CheckMessages(ctx context.Context, messages []openai.ChatCompletionMessageParamUnion) ([]openai.ChatCompletionMessageParamUnion, Findings, error) {
+	r, err := Default()
+	if err != nil {
+		return messages, nil, err
+	}
+	found := Findings{}
+	check := func(text string) (string, error) {
+		text, f, err := r.Check(text)
+		found.Add(f)
+		return text, err
+	}
+
+	out := make([]openai.ChatCompletionMessageParamUnion, len(messages))
+	for i, msg := range messages {
+		out[i] = msg
+		switch {
+		case msg.OfUser != nil:
+			u := *msg.OfUser
+			if u.Content.OfString.IsPresent() {
+				text, err := check(u.Content.OfString.Value)
+				if err != nil {
+					return messages, found, err
+				}
+				u.Content.OfString = openai.String(text)
+			} else if len(u.Content.OfArrayOfContentParts) > 0 {
+				parts := make([]openai.ChatCompletionContentPartUnionParam, len(u.Content.OfArrayOfContentParts))
+				for j, p := range u.Content.OfArrayOfContentParts {
+					if p.OfText != nil {
+						text, err := check(p.OfText.Text)
+						if err != nil {
+							return messages, found, err
+						}
+						p = openai.TextContentPart(text)
+					}
+					parts[j] = p
+				}
+				u.Content.OfArrayOfContentParts = parts
+			}
+			out[i].OfUser = &u
+		case msg.OfAssistant != nil:
+			a := *msg.OfAssistant
+			if a.Content.OfString.IsPresent() {
+				text, err := check(a.Content.OfString.Value)
+				if err != nil {
+					return messages, found, err
+				}
+				a.Content.OfString = openai.String(text)
+			}
+			out[i].OfAssistant = &a
+		case msg.OfTool != nil:
+			t := *msg.OfTool
+			if t.Content.OfString.IsPresent() {
+				text, err := check(t.Content.OfString.Value)
+				if err != nil {
+					return messages, found, err
+				}
+				t.Content.OfString = openai.String(text)
+			}
+			out[i].OfTool = &t
+		}
+	}
+	if len(found) > 0 {
+		slog.InfoContext(ctx, "sensitive data in chat history", "mode", string(r.mode), "findings", found.String())
+	}
+	return out, found, nil
+}
+
+// CheckToolOutput 检查工具返回给模型的结果：redact 模式替换敏感内容，
+// block 模式下不发送结果，改为告诉模型结果被拦截，这一轮对话继续进行
+func CheckToolOutput(ctx context.Context, text string) string {
+	text, found, err := Check(ctx, text)
+	if err != nil {
+		if len(found) > 0 {
+			return fmt.Sprintf("The tool output was withheld because it contains sensitive data: %s.", found)
+		}
+		return "The tool output was withheld because it could not be checked for sensitive data."
+	}
+	return text
+}
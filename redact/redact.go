@@ -0,0 +1,224 @@
+package redact
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mode 决定发现敏感内容时的处理方式
+type Mode string
+
+const (
+	ModeRedact Mode = "redact" // 替换为 [REDACTED:规则名] 后发送
+	ModeBlock  Mode = "block"  // 拒绝发送整条消息
+	ModeOff    Mode = "off"    // 不检查
+)
+
+// Rule 是一条检测规则，Replacement 为空时替换为 [REDACTED:Name]
+type Rule struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// builtins 是内置的检测规则，按顺序应用：私钥可能跨多行，先于其他规则处理
+var builtins = []Rule{
+	{Name: "private_key", Pattern: `-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z0-9 ]*PRIVATE KEY-----`},
+	{Name: "jwt", Pattern: `\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]+`},
+	{Name: "aws_access_key", Pattern: `\b(?:AKIA|ASIA|ABIA|ACCA)[0-9A-Z]{16}\b`},
+	{Name: "aws_secret_key", Pattern: `(?i)\baws_?secret(?:_?access)?_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}["']?`},
+	{Name: "email", Pattern: `\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`},
+}
+
+// Findings 记录每条规则命中的次数
+type Findings map[string]int
+
+// Add 合并另一组结果
+func (f Findings) Add(other Findings) {
+	for name, n := range other {
+		f[name] += n
+	}
+}
+
+// String 返回例如 "2 email, 1 aws_access_key" 的摘要，按次数从多到少排列
+func (f Findings) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if f[names[i]] != f[names[j]] {
+			return f[names[i]] > f[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%d %s", f[name], name)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// BlockedError 表示消息因包含敏感内容被拒绝
+type BlockedError struct {
+	Findings Findings
+}
+
+func (e *BlockedError) Error() string {
+	return "message blocked because it contains sensitive data: " + e.Findings.String()
+}
+
+// Blocked 让审计日志把这一轮记录为 blocked
+func (e *BlockedError) Blocked() bool {
+	return true
+}
+
+// Redactor 按规则检查并处理发往模型的文本
+type Redactor struct {
+	mode  Mode
+	rules []Rule
+}
+
+var (
+	defaultRedactor    *Redactor
+	defaultRedactorErr error
+	defaultOnce        sync.Once
+)
+
+// Default 返回按环境变量配置的 Redactor：
+// SSHTALK_REDACT 为 redact（默认）、block 或 off；
+// SSHTALK_REDACT_DETECTORS 是逗号分隔的内置规则名，默认全部启用，none 表示不使用内置规则；
+// SSHTALK_REDACT_RULES 是自定义规则的 JSON 文件：[{"name": "...", "pattern": "...", "replacement": "..."}]
+func Default() (*Redactor, error) {
+	defaultOnce.Do(func() {
+		mode := Mode(strings.ToLower(os.Getenv("SSHTALK_REDACT")))
+		if mode == "" {
+			mode = ModeRedact
+		}
+
+		var detectors []string
+		switch v := os.Getenv("SSHTALK_REDACT_DETECTORS"); v {
+		case "":
+			for _, r := range builtins {
+				detectors = append(detectors, r.Name)
+			}
+		case "none":
+		default:
+			for _, name := range strings.Split(v, ",") {
+				detectors = append(detectors, strings.TrimSpace(name))
+			}
+		}
+
+		var custom []Rule
+		if path := os.Getenv("SSHTALK_REDACT_RULES"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				defaultRedactorErr = err
+				return
+			}
+			if err := json.Unmarshal(data, &custom); err != nil {
+				defaultRedactorErr = fmt.Errorf("parse %s: %w", path, err)
+				return
+			}
+		}
+		defaultRedactor, defaultRedactorErr = New(mode, detectors, custom)
+	})
+	return defaultRedactor, defaultRedactorErr
+}
+
+// New 用指定的内置规则和自定义规则创建 Redactor
+func New(mode Mode, detectors []string, custom []Rule) (*Redactor, error) {
+	switch mode {
+	case ModeRedact, ModeBlock, ModeOff:
+	default:
+		return nil, fmt.Errorf("unknown redaction mode %q, expected redact, block or off", mode)
+	}
+
+	r := &Redactor{mode: mode}
+	for _, name := range detectors {
+		found := false
+		for _, b := range builtins {
+			if b.Name == name {
+				r.rules = append(r.rules, b)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown redaction detector %q", name)
+		}
+	}
+	r.rules = append(r.rules, custom...)
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if rule.Name == "" || rule.Pattern == "" {
+			return nil, fmt.Errorf("redaction rule %d needs a name and a pattern", i+1)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redaction rule %s: %w", rule.Name, err)
+		}
+		rule.re = re
+		if rule.Replacement == "" {
+			rule.Replacement = "[REDACTED:" + rule.Name + "]"
+		}
+	}
+	return r, nil
+}
+
+// Mode 返回处理方式
+func (r *Redactor) Mode() Mode {
+	return r.mode
+}
+
+// Redact 替换文本中所有命中规则的内容，返回替换后的文本和命中的规则
+func (r *Redactor) Redact(text string) (string, Findings) {
+	found := Findings{}
+	if r.mode == ModeOff {
+		return text, found
+	}
+	for _, rule := range r.rules {
+		text = rule.re.ReplaceAllStringFunc(text, func(string) string {
+			found[rule.Name]++
+			return rule.Replacement
+		})
+	}
+	return text, found
+}
+
+// Check 按处理方式检查文本：redact 模式返回替换后的文本，
+// block 模式在发现敏感内容时返回 *BlockedError，文本保持不变
+func (r *Redactor) Check(text string) (string, Findings, error) {
+	redacted, found := r.Redact(text)
+	if len(found) == 0 {
+		return text, found, nil
+	}
+	if r.mode == ModeBlock {
+		return text, found, &BlockedError{Findings: found}
+	}
+	return redacted, found, nil
+}
+
+// Check 使用默认的 Redactor 检查即将发往模型的文本，处理结果记录到日志（不含内容）。
+// 配置有误时返回错误，消息不会被发送
+func Check(ctx context.Context, text string) (string, Findings, error) {
+	r, err := Default()
+	if err != nil {
+		return text, nil, err
+	}
+	text, found, err := r.Check(text)
+	if len(found) > 0 {
+		slog.InfoContext(ctx, "sensitive data in prompt", "mode", string(r.mode), "findings", found.String())
+	}
+	return text, found, err
+}
@@ -0,0 +1,329 @@
+package room
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 触发 AI 回复的提及
+const Mention = "@ai"
+
+// AIName 是 AI 参与者在房间中的名字
+const AIName = "ai"
+
+// 房间保留的历史消息条数
+const historySize = 50
+
+// Message 是房间中的一条消息
+type Message struct {
+	ID      int64
+	From    string
+	Content string
+	AI      bool // 是否由 AI 发送
+	Done    bool // AI 消息是否已生成完毕，人类消息始终为 true
+	Time    time.Time
+}
+
+// Event 是推送给成员的房间事件，Message 和 Members 二选一
+type Event struct {
+	Message *Message
+	Members []string // 在线成员列表
+}
+
+// Responder 根据房间历史生成 AI 回复，update 会被多次调用并传入当前累积的内容
+type Responder func(ctx context.Context, history []Message, update func(content string)) (string, error)
+
+// Hub 管理进程内的所有房间
+type Hub struct {
+	mu        sync.Mutex
+	rooms     map[string]*Room
+	responder Responder
+}
+
+// Room 是一个多人聊天房间
+type Room struct {
+	Name string
+
+	hub     *Hub
+	mu      sync.Mutex
+	members map[*Member]struct{}
+	history []Message
+	nextID  int64
+	aiBusy  bool
+	aiAgain bool // 生成回复期间又有人提到了 AI，结束后再回复一次
+}
+
+// Member 是房间中的一个会话
+type Member struct {
+	Name string
+
+	room *Room
+	mu   sync.Mutex
+	cond *sync.Cond
+	// 还没有被 Next 取走的事件。同一条消息的多次更新和在线成员列表只保留最新的一个，
+	// 消费过慢时合并事件而不阻塞房间，也不会丢失消息的最终内容
+	queue []Event
+	left  bool
+}
+
+var defaultHub = NewHub()
+
+// Default 返回进程内共享的 Hub
+func Default() *Hub {
+	return defaultHub
+}
+
+// NewHub 创建一个空的 Hub
+func NewHub() *Hub {
+	return &Hub{rooms: map[string]*Room{}}
+}
+
+// SetResponder 设置 AI 回复的生成方式，未设置时 @ai 不会得到回复
+func (h *Hub) SetResponder(r Responder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.responder = r
+}
+
+// Rooms 返回当前有成员的房间名
+func (h *Hub) Rooms() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := make([]string, 0, len(h.rooms))
+	for name := range h.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Join 以 name 的身份加入房间，房间不存在时自动创建
+func (h *Hub) Join(roomName, name string) *Member {
+	h.mu.Lock()
+	r, ok := h.rooms[roomName]
+	if !ok {
+		r = &Room{Name: roomName, hub: h, members: map[*Member]struct{}{}}
+		h.rooms[roomName] = r
+	}
+
+	m := &Member{Name: name, room: r}
+	m.cond = sync.NewCond(&m.mu)
+
+	r.mu.Lock()
+	r.members[m] = struct{}{}
+	// 新成员先收到最近的历史
+	for i := range r.history {
+		msg := r.history[i]
+		m.push(Event{Message: &msg})
+	}
+	r.mu.Unlock()
+	h.mu.Unlock()
+
+	r.broadcastPresence()
+	return m
+}
+
+// Leave 离开房间，最后一个成员离开时房间被删除
+func (m *Member) Leave() {
+	r := m.room
+	r.hub.mu.Lock()
+	r.mu.Lock()
+	if _, ok := r.members[m]; !ok {
+		r.mu.Unlock()
+		r.hub.mu.Unlock()
+		return
+	}
+	delete(r.members, m)
+	m.mu.Lock()
+	m.left = true
+	m.queue = nil
+	m.cond.Broadcast()
+	m.mu.Unlock()
+	empty := len(r.members) == 0
+	if empty {
+		delete(r.hub.rooms, r.Name)
+	}
+	r.mu.Unlock()
+	r.hub.mu.Unlock()
+
+	if !empty {
+		r.broadcastPresence()
+	}
+}
+
+// Room 返回成员所在的房间
+func (m *Member) Room() *Room {
+	return m.room
+}
+
+// Send 向房间发送一条消息，消息中提及 @ai 时触发 AI 回复
+func (m *Member) Send(content string) {
+	r := m.room
+	r.mu.Lock()
+	r.nextID++
+	msg := Message{ID: r.nextID, From: m.Name, Content: content, Done: true, Time: time.Now()}
+	r.appendLocked(msg)
+	r.mu.Unlock()
+
+	if mentionsAI(content) {
+		go r.respond()
+	}
+}
+
+// mentionsAI 返回消息是否提及 AI。@ai 必须是一个独立的词，可以带标点，
+// bob@ai.example 和 @aim 不算
+func mentionsAI(content string) bool {
+	for _, word := range strings.Fields(content) {
+		word = strings.TrimLeft(word, "([{\"'")
+		word = strings.TrimRight(word, ".,!?:;)]}\"'")
+		if strings.EqualFold(word, Mention) {
+			return true
+		}
+	}
+	return false
+}
+
+// Members 返回在线成员名，同名的多个会话只计一次
+func (r *Room) Members() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.membersLocked()
+}
+
+func (r *Room) membersLocked() []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for m := range r.members {
+		if !seen[m.Name] {
+			seen[m.Name] = true
+			names = append(names, m.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Room) broadcastPresence() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := r.membersLocked()
+	for m := range r.members {
+		m.push(Event{Members: names})
+	}
+}
+
+// appendLocked 记录消息并广播，调用方需持有 r.mu
+func (r *Room) appendLocked(msg Message) {
+	// 流式生成的 AI 消息会以相同 ID 多次更新
+	updated := false
+	for i := len(r.history) - 1; i >= 0; i-- {
+		if r.history[i].ID == msg.ID {
+			r.history[i] = msg
+			updated = true
+			break
+		}
+	}
+	if !updated {
+		r.history = append(r.history, msg)
+		if len(r.history) > historySize {
+			r.history = r.history[len(r.history)-historySize:]
+		}
+	}
+	for m := range r.members {
+		msg := msg
+		m.push(Event{Message: &msg})
+	}
+}
+
+// respond 让 AI 根据房间历史回复，同一时间每个房间只有一个回复在生成。
+// 生成期间收到的提及不会丢失：当前回复结束后根据新的历史再回复一次
+func (r *Room) respond() {
+	r.hub.mu.Lock()
+	responder := r.hub.responder
+	r.hub.mu.Unlock()
+	if responder == nil {
+		return
+	}
+
+	r.mu.Lock()
+	if r.aiBusy {
+		r.aiAgain = true
+		r.mu.Unlock()
+		return
+	}
+	r.aiBusy = true
+	r.mu.Unlock()
+
+	for {
+		r.reply(responder)
+
+		r.mu.Lock()
+		if !r.aiAgain {
+			r.aiBusy = false
+			r.mu.Unlock()
+			return
+		}
+		r.aiAgain = false
+		r.mu.Unlock()
+	}
+}
+
+// reply 生成一条 AI 回复，生成过程中的内容实时广播
+func (r *Room) reply(responder Responder) {
+	r.mu.Lock()
+	history := append([]Message(nil), r.history...)
+	r.nextID++
+	id := r.nextID
+	r.mu.Unlock()
+
+	update := func(content string, done bool) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.appendLocked(Message{ID: id, From: AIName, Content: content, AI: true, Done: done, Time: time.Now()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	content, err := responder(ctx, history, func(content string) { update(content, false) })
+	if err != nil {
+		content = "Error: " + err.Error()
+	}
+	update(content, true)
+}
+
+// Next 等待下一个事件，离开房间后返回 false
+func (m *Member) Next() (Event, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.queue) == 0 && !m.left {
+		m.cond.Wait()
+	}
+	if m.left {
+		return Event{}, false
+	}
+	e := m.queue[0]
+	m.queue = m.queue[1:]
+	return e, true
+}
+
+// push 非阻塞地投递事件，调用方需持有 room 的锁。
+// 队列中已有同一条消息或在线成员列表时用新事件替换，流式生成的消息只保留最新的内容
+func (m *Member) push(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.left {
+		return
+	}
+	for i, queued := range m.queue {
+		sameMessage := e.Message != nil && queued.Message != nil && queued.Message.ID == e.Message.ID
+		if sameMessage || e.Message == nil && queued.Message == nil {
+			m.queue[i] = e
+			return
+		}
+	}
+	m.queue = append(m.queue, e)
+	m.cond.Signal()
+}
@@ -0,0 +1,117 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"sshtalk/drain"
+	"sshtalk/provider"
+	"sshtalk/store"
+)
+
+// 就绪检查中上游请求的超时时间，以及结果的缓存时间，避免探针频繁请求上游
+const (
+	providerCheckTimeout = 3 * time.Second
+	providerCheckTTL     = 10 * time.Second
+)
+
+// readiness 是 /readyz 的响应
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+var (
+	providerMu      sync.Mutex
+	providerChecked time.Time
+	providerErr     error
+)
+
+// checkProvider 通过列出模型检查上游是否可达
+func checkProvider(ctx context.Context) error {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	if time.Since(providerChecked) < providerCheckTTL {
+		return providerErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, providerCheckTimeout)
+	defer cancel()
+	_, providerErr = provider.Default().Models(ctx)
+	providerChecked = time.Now()
+	return providerErr
+}
+
+// checkStorage 检查数据目录是否可写
+func checkStorage() error {
+	st, err := store.Default()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(st.Dir(), ".ready-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Register 在 mux 上注册 /healthz、/readyz 和 /metrics
+func Register(mux *http.ServeMux) {
+	// 进程存活即返回成功
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+
+	// 上游和存储都可用时才接收流量，服务器关闭时不再接收
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		res := readiness{Status: "ok", Checks: map[string]string{"provider": "ok", "storage": "ok"}}
+		if drain.Draining() {
+			res.Status = "unavailable"
+			res.Checks["shutdown"] = "draining"
+		}
+		if err := checkProvider(r.Context()); err != nil {
+			res.Status = "unavailable"
+			res.Checks["provider"] = err.Error()
+		}
+		if err := checkStorage(); err != nil {
+			res.Status = "unavailable"
+			res.Checks["storage"] = err.Error()
+		}
+
+		status := http.StatusOK
+		if res.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(res)
+	})
+
+	mux.Handle("GET /metrics", promhttp.Handler())
+}
+
+// Start 在 addr 上启动只提供管理接口的 HTTP 服务，用于没有 HTTP 接口的 SSH 服务器
+func Start(addr string) {
+	mux := http.NewServeMux()
+	Register(mux)
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	slog.Info("starting admin server", "addr", addr)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("admin server error", "err", err)
+		}
+	}()
+}
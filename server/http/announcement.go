@@ -0,0 +1,48 @@
+package http
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"sshtalk/motd"
+)
+
+// announcement 是 /api/admin/announcement 的请求和响应
+type announcement struct {
+	Text string `json:"text"`
+}
+
+// registerAnnouncementRoutes 注册公告接口。公告显示在之后开始的 SSH 和网页终端会话的欢迎消息中，需要 admin 权限
+func registerAnnouncementRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/admin/announcement", func(w http.ResponseWriter, r *http.Request) {
+		text, err := motd.Announcement()
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, announcement{Text: text})
+	})
+
+	mux.HandleFunc("PUT /api/admin/announcement", func(w http.ResponseWriter, r *http.Request) {
+		var req announcement
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if err := motd.SetAnnouncement(req.Text); err != nil {
+			internalError(w, r, err)
+			return
+		}
+		slog.InfoContext(r.Context(), "announcement updated", "length", len(req.Text))
+		writeJSON(w, http.StatusOK, announcement{Text: strings.TrimSpace(req.Text)})
+	})
+
+	mux.HandleFunc("DELETE /api/admin/announcement", func(w http.ResponseWriter, r *http.Request) {
+		if err := motd.SetAnnouncement(""); err != nil {
+			internalError(w, r, err)
+			return
+		}
+		slog.InfoContext(r.Context(), "announcement cleared")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
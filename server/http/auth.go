@@ -0,0 +1,89 @@
+package http
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"sshtalk/audit"
+	"sshtalk/auth"
+	"sshtalk/logger"
+)
+
+// protected 判断路径是否需要令牌
+func protected(path string) bool {
+	return strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/v1/")
+}
+
+// isWebSocket 判断是否为 WebSocket 握手请求
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// requiredScope 返回请求需要的最低权限：管理接口需要 admin，读取类请求只需 read-only，
+// 其余（包括 WebSocket 会话）需要 chat
+func requiredScope(r *http.Request) auth.Scope {
+	if strings.HasPrefix(r.URL.Path, "/api/admin/") {
+		return auth.ScopeAdmin
+	}
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && !isWebSocket(r) {
+		return auth.ScopeReadOnly
+	}
+	return auth.ScopeChat
+}
+
+// bearerToken 从 Authorization 头中取出令牌。
+// 浏览器无法为 WebSocket 握手设置请求头，握手请求也可以使用 access_token 参数
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if isWebSocket(r) {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// authMiddleware 校验 /api/* 和 /v1/* 请求的 Bearer 令牌，并检查令牌权限
+func authMiddleware(tokens *auth.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !protected(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		plain := bearerToken(r)
+		if plain == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sshtalk"`)
+			writeAPIError(w, http.StatusUnauthorized, "authentication_error", "Missing bearer token")
+			return
+		}
+		t, err := tokens.Verify(plain)
+		switch {
+		case errors.Is(err, auth.ErrInvalidToken), errors.Is(err, auth.ErrExpiredToken):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sshtalk", error="invalid_token"`)
+			writeAPIError(w, http.StatusUnauthorized, "authentication_error", "Invalid or expired token")
+			return
+		case err != nil:
+			slog.ErrorContext(r.Context(), "token store error", "err", err)
+			writeAPIError(w, http.StatusInternalServerError, "server_error", "Internal server error")
+			return
+		}
+
+		if required := requiredScope(r); !t.Scope.Allows(required) {
+			writeAPIError(w, http.StatusForbidden, "permission_error", "Token scope "+string(t.Scope)+" does not allow this request, "+string(required)+" is required")
+			return
+		}
+		ctx := logger.With(auth.WithToken(r.Context(), t), slog.String("token_id", t.ID))
+		ctx = audit.WithActor(ctx, audit.Actor{Source: "http", Identity: t.Owner, Token: t.Name, RemoteAddr: r.RemoteAddr})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIdentity 返回请求者的身份，即令牌的所有者，用于限定可访问的对话
+func requestIdentity(r *http.Request) string {
+	t, _ := auth.FromContext(r.Context())
+	return t.Owner
+}
@@ -0,0 +1,158 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/openai/openai-go"
+	"go.opentelemetry.io/otel/attribute"
+
+	"sshtalk/audit"
+	"sshtalk/mcp"
+	"sshtalk/provider"
+	"sshtalk/redact"
+	"sshtalk/tracing"
+)
+
+// 单次请求中最多执行的工具调用轮数
+const maxToolRounds = 8
+
+// chatService 负责生成回复，/api/chat 和 /api/ws 共用
+type chatService struct {
+	llm   *provider.Provider
+	mcp   *mcp.Manager
+	tools []openai.ChatCompletionToolParam
+}
+
+// chatReply 是一次完整回复的结果
+type chatReply struct {
+	Content      string
+	Usage        usageEvent
+	FinishReason string
+	Notes        []string // 审核钩子对回复的提示
+}
+
+// complete 流式生成回复，每段增量内容调用 onDelta，onDelta 返回错误时停止。
+// 模型可能多次请求工具，每轮把工具结果追加到消息后重新请求。
+// 回复被审核钩子拒绝时返回 *moderation.BlockedError，reply.Content 是已经发出的部分
+func (c *chatService) complete(ctx context.Context, messages []openai.ChatCompletionMessageParamUnion, onDelta func(string) error) (reply chatReply, err error) {
+	// 一轮对话包括所有上游请求和工具调用
+	ctx, span := tracing.Tracer().Start(ctx, "chat turn")
+	prompt := lastUserPrompt(messages)
+	start := time.Now()
+	defer func() {
+		e := audit.Entry{
+			Model:            c.llm.Model,
+			Prompt:           prompt,
+			Response:         reply.Content,
+			PromptTokens:     reply.Usage.PromptTokens,
+			CompletionTokens: reply.Usage.CompletionTokens,
+			Outcome:          audit.Outcome(err),
+			DurationMS:       time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		audit.Record(ctx, e)
+
+		span.SetAttributes(
+			attribute.Int("sshtalk.messages", len(messages)),
+			attribute.Int64("gen_ai.usage.input_tokens", reply.Usage.PromptTokens),
+			attribute.Int64("gen_ai.usage.output_tokens", reply.Usage.CompletionTokens),
+			attribute.String("sshtalk.finish_reason", reply.FinishReason),
+		)
+		if err != nil {
+			tracing.RecordError(span, err)
+		}
+		span.End()
+	}()
+
+	var content strings.Builder
+	for round := 0; round < maxToolRounds; round++ {
+		stream := c.llm.NewStreaming(ctx, openai.ChatCompletionNewParams{
+			Messages: messages,
+			Tools:    c.tools,
+			StreamOptions: openai.ChatCompletionStreamOptionsParam{
+				IncludeUsage: openai.Bool(true),
+			},
+		})
+
+		acc := openai.ChatCompletionAccumulator{}
+		for stream.Next() {
+			chunk := stream.Current()
+			acc.AddChunk(chunk)
+			if len(chunk.Choices) > 0 {
+				if delta := chunk.Choices[0].Delta.Content; delta != "" {
+					content.WriteString(delta)
+					if err := onDelta(delta); err != nil {
+						stream.Close()
+						reply.Content = content.String()
+						return reply, err
+					}
+				}
+			}
+		}
+		reply.Content = content.String()
+		reply.Notes = append(reply.Notes, stream.Notes()...)
+		if err := stream.Err(); err != nil {
+			return reply, err
+		}
+
+		reply.Usage.PromptTokens += acc.Usage.PromptTokens
+		reply.Usage.CompletionTokens += acc.Usage.CompletionTokens
+		reply.Usage.TotalTokens += acc.Usage.TotalTokens
+		if len(acc.Choices) > 0 {
+			reply.FinishReason = acc.Choices[0].FinishReason
+		}
+
+		if len(acc.Choices) == 0 || len(acc.Choices[0].Message.ToolCalls) == 0 {
+			break
+		}
+		if round == maxToolRounds-1 {
+			// 达到轮数上限：不再执行工具，结果无法交给模型
+			reply.Notes = append(reply.Notes, fmt.Sprintf("Stopped after %d rounds of tool calls", maxToolRounds))
+			break
+		}
+		messages = append(messages, acc.Choices[0].Message.ToParam())
+		messages = append(messages, c.callTools(ctx, acc.Choices[0].Message.ToolCalls)...)
+	}
+	return reply, nil
+}
+
+// lastUserPrompt 返回最后一条用户消息的文本，审计日志把它作为这一轮的提问
+func lastUserPrompt(messages []openai.ChatCompletionMessageParamUnion) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if u := messages[i].OfUser; u != nil {
+			if u.Content.OfString.IsPresent() {
+				return u.Content.OfString.Value
+			}
+			var parts []string
+			for _, p := range u.Content.OfArrayOfContentParts {
+				if p.OfText != nil {
+					parts = append(parts, p.OfText.Text)
+				}
+			}
+			return strings.Join(parts, "\n")
+		}
+	}
+	return ""
+}
+
+// callTools 执行模型请求的工具调用。HTTP 接口无法向用户确认，只执行配置为自动批准的工具
+func (c *chatService) callTools(ctx context.Context, calls []openai.ChatCompletionMessageToolCall) []openai.ChatCompletionMessageParamUnion {
+	results := make([]openai.ChatCompletionMessageParamUnion, 0, len(calls))
+	for _, call := range calls {
+		if !c.mcp.AutoApproved(call.Function.Name) {
+			results = append(results, openai.ToolMessage("This tool requires user confirmation and cannot be run from the HTTP API.", call.ID))
+			continue
+		}
+		content, err := c.mcp.Call(ctx, call.Function.Name, call.Function.Arguments)
+		if err != nil {
+			content = fmt.Sprintf("Error: %v", err)
+		}
+		results = append(results, openai.ToolMessage(redact.CheckToolOutput(ctx, content), call.ID))
+	}
+	return results
+}
@@ -0,0 +1,311 @@
+package http
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sshtalk/conversation"
+	"sshtalk/provider"
+	"sshtalk/store"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// 列表接口的默认和最大分页大小
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// conversationSummary 是列表接口返回的对话概要，不包含消息内容
+type conversationSummary struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	Model        string    `json:"model"`
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+	MessageCount int       `json:"message_count"`
+}
+
+type conversationPage struct {
+	Conversations []conversationSummary `json:"conversations"`
+	Total         int                   `json:"total"`
+	Limit         int                   `json:"limit"`
+	Offset        int                   `json:"offset"`
+}
+
+type createConversationRequest struct {
+	Title    string                 `json:"title"`
+	Model    string                 `json:"model"`
+	Messages []conversation.Message `json:"messages"`
+}
+
+type updateConversationRequest struct {
+	Title *string `json:"title"`
+}
+
+// writeJSON 以 JSON 格式写出响应
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// decodeJSON 读取请求体，失败时写出 400 并返回 false
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxRequestBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// pagination 解析 limit 和 offset 参数
+func pagination(r *http.Request) (limit, offset int) {
+	limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+	offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
+	return limit, max(offset, 0)
+}
+
+// validMessage 检查客户端提交的消息，补上缺省的时间
+func validMessage(m *conversation.Message) error {
+	switch m.Role {
+	case conversation.RoleUser, conversation.RoleAssistant, conversation.RoleTool:
+	default:
+		return errors.New("role must be user, assistant or tool")
+	}
+	if strings.TrimSpace(m.Content) == "" {
+		return errors.New("content is required")
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	return nil
+}
+
+// conversationAPI 实现 /api/conversations 接口，数据与 SSH 会话共用同一个存储
+type conversationAPI struct {
+	// mu 串行化本进程内的读-改-写，避免并发追加时丢失消息。
+	// 其他会话同时保存时由存储的版本检查发现冲突
+	mu sync.Mutex
+}
+
+// registerConversationRoutes 注册对话管理接口
+func registerConversationRoutes(mux *http.ServeMux) {
+	api := &conversationAPI{}
+	mux.HandleFunc("GET /api/conversations", api.list)
+	mux.HandleFunc("POST /api/conversations", api.create)
+	mux.HandleFunc("GET /api/conversations/{id}", api.get)
+	mux.HandleFunc("PATCH /api/conversations/{id}", api.update)
+	mux.HandleFunc("DELETE /api/conversations/{id}", api.delete)
+	mux.HandleFunc("POST /api/conversations/{id}/messages", api.appendMessage)
+
+	mux.HandleFunc("GET /api/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+	})
+}
+
+// internalError 记录存储错误并返回 500，不向客户端暴露细节
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	slog.ErrorContext(r.Context(), "store error", "err", err)
+	writeAPIError(w, http.StatusInternalServerError, "server_error", "Internal server error")
+}
+
+// saveError 处理保存修改后的对话时的错误：对话在读取之后被 SSH 或 WebSocket 会话修改过时返回 409，客户端可以重试
+func saveError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, store.ErrConflict) {
+		writeAPIError(w, http.StatusConflict, "conflict_error", "Conversation was modified by another session, please retry")
+		return
+	}
+	internalError(w, r, err)
+}
+
+// openStore 打开默认存储，失败时写出 500
+func openStore(w http.ResponseWriter, r *http.Request) *store.Store {
+	st, err := store.Default()
+	if err != nil {
+		internalError(w, r, err)
+		return nil
+	}
+	return st
+}
+
+// load 读取属于请求者的对话，其他人的对话一律视为不存在
+func (api *conversationAPI) load(w http.ResponseWriter, r *http.Request, st *store.Store) (conversation.Conversation, bool) {
+	c, err := st.Get(r.PathValue("id"))
+	if err == nil && c.Owner != requestIdentity(r) {
+		err = store.ErrNotFound
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found_error", "Conversation not found")
+		return c, false
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return c, false
+	}
+	return c, true
+}
+
+func (api *conversationAPI) list(w http.ResponseWriter, r *http.Request) {
+	st := openStore(w, r)
+	if st == nil {
+		return
+	}
+	list, err := st.List(requestIdentity(r))
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	limit, offset := pagination(r)
+	page := conversationPage{Conversations: []conversationSummary{}, Total: len(list), Limit: limit, Offset: offset}
+	for _, c := range list[min(offset, len(list)):min(offset+limit, len(list))] {
+		page.Conversations = append(page.Conversations, conversationSummary{
+			ID:           c.ID,
+			Title:        c.Title,
+			Model:        c.Model,
+			Created:      c.Created,
+			Updated:      c.Updated,
+			MessageCount: len(c.Messages),
+		})
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (api *conversationAPI) create(w http.ResponseWriter, r *http.Request) {
+	var req createConversationRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	for i := range req.Messages {
+		if err := validMessage(&req.Messages[i]); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+	}
+	st := openStore(w, r)
+	if st == nil {
+		return
+	}
+
+	c := conversation.Conversation{
+		Owner:    requestIdentity(r),
+		Title:    strings.TrimSpace(req.Title),
+		Model:    req.Model,
+		Created:  time.Now(),
+		Messages: req.Messages,
+	}
+	if c.Model == "" {
+		c.Model = provider.Default().Model
+	}
+	if c.Messages == nil {
+		c.Messages = []conversation.Message{}
+	}
+	if err := st.Save(&c); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
+
+func (api *conversationAPI) get(w http.ResponseWriter, r *http.Request) {
+	st := openStore(w, r)
+	if st == nil {
+		return
+	}
+	if c, ok := api.load(w, r, st); ok {
+		writeJSON(w, http.StatusOK, c)
+	}
+}
+
+func (api *conversationAPI) update(w http.ResponseWriter, r *http.Request) {
+	var req updateConversationRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Title == nil || strings.TrimSpace(*req.Title) == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "title is required")
+		return
+	}
+	st := openStore(w, r)
+	if st == nil {
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	c, ok := api.load(w, r, st)
+	if !ok {
+		return
+	}
+	c.Title = strings.TrimSpace(*req.Title)
+	if err := st.Update(&c, c.Updated); err != nil {
+		saveError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (api *conversationAPI) delete(w http.ResponseWriter, r *http.Request) {
+	st := openStore(w, r)
+	if st == nil {
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	c, ok := api.load(w, r, st)
+	if !ok {
+		return
+	}
+	if err := st.Delete(c.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+		internalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *conversationAPI) appendMessage(w http.ResponseWriter, r *http.Request) {
+	var msg conversation.Message
+	if !decodeJSON(w, r, &msg) {
+		return
+	}
+	if err := validMessage(&msg); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	st := openStore(w, r)
+	if st == nil {
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	c, ok := api.load(w, r, st)
+	if !ok {
+		return
+	}
+	c.Messages = append(c.Messages, msg)
+	if err := st.Update(&c, c.Updated); err != nil {
+		saveError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, msg)
+}
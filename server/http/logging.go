@@ -0,0 +1,67 @@
+package http
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"sshtalk/logger"
+)
+
+// 只接受由字母、数字和 -_.: 组成且不超过 64 个字符的 X-Request-ID，其余情况生成新的 ID
+const maxRequestIDLen = 64
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// quietRoutes 是探针和指标抓取的路由，只在 debug 级别记录
+var quietRoutes = map[string]bool{
+	"GET /healthz": true,
+	"GET /readyz":  true,
+	"GET /metrics": true,
+}
+
+// loggingMiddleware 为每个请求分配请求 ID，放入 X-Request-ID 响应头和日志 context，
+// 并在请求结束后记录一行访问日志
+func loggingMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = logger.NewID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := logger.With(r.Context(), slog.String("request_id", id))
+
+		_, route := mux.Handler(r)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if quietRoutes[route] {
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,74 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"sshtalk/moderation"
+)
+
+// codePolicyViolation 是被使用策略拒绝时的错误码，所有接口相同
+const codePolicyViolation = "content_policy_violation"
+
+// moderationNotesHeader 列出审核钩子对用户消息的提示，多条提示用 "; " 分隔
+const moderationNotesHeader = "X-Moderation-Notes"
+
+// moderateInput 检查发往模型的用户消息，返回 annotate 的提示。
+// 被拒绝时返回 *moderation.BlockedError
+func moderateInput(ctx context.Context, texts ...string) ([]string, error) {
+	m, err := moderation.Default()
+	if err != nil {
+		return nil, err
+	}
+	var notes []string
+	for _, text := range texts {
+		found, err := m.Check(ctx, moderation.StageInput, text)
+		notes = mergeNotes(notes, found)
+		if err != nil {
+			return notes, err
+		}
+	}
+	return notes, nil
+}
+
+// mergeNotes 合并两组审核提示，相同的提示只保留一次
+func mergeNotes(notes, more []string) []string {
+	for _, n := range more {
+		if !slices.Contains(notes, n) {
+			notes = append(notes, n)
+		}
+	}
+	return notes
+}
+
+// asBlocked 返回 err 中的审核拒绝
+func asBlocked(err error) (*moderation.BlockedError, bool) {
+	var blocked *moderation.BlockedError
+	ok := errors.As(err, &blocked)
+	return blocked, ok
+}
+
+// policyError 把审核拒绝转换为 OpenAI 格式的错误
+func policyError(b *moderation.BlockedError) apiError {
+	return apiError{
+		Message: b.Error(),
+		Type:    "invalid_request_error",
+		Code:    codePolicyViolation,
+		Stage:   string(b.Stage),
+	}
+}
+
+// writePolicyError 以 400 返回审核拒绝
+func writePolicyError(w http.ResponseWriter, b *moderation.BlockedError) {
+	writeError(w, http.StatusBadRequest, policyError(b))
+}
+
+// setNotesHeader 在响应头中列出审核提示，没有提示时不设置
+func setNotesHeader(w http.ResponseWriter, notes []string) {
+	if len(notes) > 0 {
+		w.Header().Set(moderationNotesHeader, strings.Join(notes, "; "))
+	}
+}
@@ -0,0 +1,308 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+
+	"sshtalk/audit"
+	"sshtalk/drain"
+	"sshtalk/provider"
+	"sshtalk/redact"
+)
+
+// 请求体大小上限
+const maxRequestBody = 8 << 20
+
+// apiError 是 OpenAI 格式的错误响应
+type apiError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+	// Stage 只在被审核拒绝时出现：input 表示用户消息，output 表示模型回复
+	Stage string `json:"stage,omitempty"`
+}
+
+// writeAPIError 按 OpenAI 的格式返回错误
+func writeAPIError(w http.ResponseWriter, status int, errType, message string) {
+	writeError(w, status, apiError{Message: message, Type: errType})
+}
+
+func writeError(w http.ResponseWriter, status int, e apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]apiError{"error": e})
+}
+
+// upstreamError 把上游错误转换为 OpenAI 格式返回
+func upstreamError(w http.ResponseWriter, err error) {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		writeAPIError(w, apiErr.StatusCode, "upstream_error", apiErr.Message)
+		return
+	}
+	writeAPIError(w, http.StatusBadGateway, "upstream_error", "upstream model request failed")
+}
+
+// registerOpenAIRoutes 注册兼容 OpenAI 的 /v1 接口，其他工具可以把 sshtalk 当作 OpenAI 服务使用
+func registerOpenAIRoutes(mux *http.ServeMux, llm *provider.Provider) {
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+			return
+		}
+		models, err := llm.Models(r.Context())
+		if err != nil {
+			// 有些兼容服务不提供模型列表，此时只返回默认模型
+			slog.WarnContext(r.Context(), "list models failed", "err", err)
+			models = []openai.Model{{ID: llm.Model, Object: "model", OwnedBy: "sshtalk"}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": models})
+	})
+
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+			return
+		}
+
+		// 请求体原样转发，只在缺少模型时补上默认模型
+		var body map[string]any
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBody)).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON body")
+			return
+		}
+		messages, ok := body["messages"].([]any)
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "messages is required")
+			return
+		}
+		model, _ := body["model"].(string)
+		if model == "" {
+			model = llm.Model
+			body["model"] = model
+		}
+		checker := newPromptChecker(r)
+		if err := redactMessages(checker, messages); err != nil {
+			var blocked *redact.BlockedError
+			if errors.As(err, &blocked) {
+				audit.RecordBlocked(r.Context(), model, "", err)
+				writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+				return
+			}
+			slog.ErrorContext(r.Context(), "redaction error", "err", err)
+			writeAPIError(w, http.StatusInternalServerError, "server_error", "Internal server error")
+			return
+		}
+		checker.setHeader(w)
+		notes, err := moderateInput(r.Context(), userContents(messages)...)
+		if err != nil {
+			if blocked, ok := asBlocked(err); ok {
+				audit.RecordBlocked(r.Context(), model, lastUserContent(messages), err)
+				writePolicyError(w, blocked)
+				return
+			}
+			if r.Context().Err() == nil {
+				slog.ErrorContext(r.Context(), "moderation error", "err", err)
+				writeAPIError(w, http.StatusInternalServerError, "server_error", "Internal server error")
+			}
+			return
+		}
+		setNotesHeader(w, notes)
+		stream, _ := body["stream"].(bool)
+		raw, err := json.Marshal(body)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		rawBody := option.WithRequestBody("application/json", raw)
+		// 请求体由 rawBody 替换，params 只用于 span 和指标中的模型名
+		params := openai.ChatCompletionNewParams{Model: model}
+
+		// 请求结束时写入审计日志
+		var (
+			response string
+			usage    openai.CompletionUsage
+			callErr  error
+		)
+		start := time.Now()
+		defer func() {
+			e := audit.Entry{
+				Model:            model,
+				Prompt:           lastUserContent(messages),
+				Response:         response,
+				PromptTokens:     usage.PromptTokens,
+				CompletionTokens: usage.CompletionTokens,
+				Outcome:          audit.Outcome(callErr),
+				DurationMS:       time.Since(start).Milliseconds(),
+			}
+			if callErr != nil {
+				e.Error = callErr.Error()
+			}
+			audit.Record(r.Context(), e)
+		}()
+
+		if !stream {
+			res, err := llm.New(r.Context(), params, rawBody)
+			if err != nil {
+				callErr = err
+				if blocked, ok := asBlocked(err); ok {
+					writePolicyError(w, blocked)
+					return
+				}
+				upstreamError(w, err)
+				return
+			}
+			if len(res.Choices) > 0 {
+				response = res.Choices[0].Message.Content
+			}
+			usage = res.Usage
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, res.RawJSON())
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeAPIError(w, http.StatusInternalServerError, "server_error", "Streaming unsupported")
+			return
+		}
+
+		s := llm.NewStreaming(r.Context(), params, rawBody)
+		defer s.Close()
+
+		// 在收到第一个块之前出错时还可以返回正常的错误响应
+		started := false
+		acc := openai.ChatCompletionAccumulator{}
+		defer func() {
+			if len(acc.Choices) > 0 {
+				response = acc.Choices[0].Message.Content
+			}
+			usage = acc.Usage
+		}()
+		for s.Next() {
+			acc.AddChunk(s.Current())
+			if !started {
+				started = true
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Header().Set("Cache-Control", "no-cache")
+				w.Header().Set("Connection", "keep-alive")
+				w.WriteHeader(http.StatusOK)
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", s.Current().RawJSON()); err != nil {
+				slog.DebugContext(r.Context(), "error writing response", "err", err)
+				callErr = err
+				return
+			}
+			flusher.Flush()
+		}
+
+		if err := s.Err(); err != nil {
+			callErr = err
+			blocked, isBlocked := asBlocked(err)
+			if !started {
+				if isBlocked {
+					writePolicyError(w, blocked)
+					return
+				}
+				upstreamError(w, err)
+				return
+			}
+			e := apiError{Message: "upstream stream failed", Type: "upstream_error"}
+			switch {
+			case isBlocked:
+				e = policyError(blocked)
+			case drain.Draining() && errors.Is(err, context.Canceled):
+				e = apiError{Message: "server is shutting down", Type: "server_error"}
+			}
+			data, _ := json.Marshal(map[string]apiError{"error": e})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+		flusher.Flush()
+	})
+}
+
+// redactMessages 就地替换请求消息中的敏感内容，content 可以是字符串或内容片段数组
+func redactMessages(checker *promptChecker, messages []any) error {
+	for _, m := range messages {
+		msg, _ := m.(map[string]any)
+		switch content := msg["content"].(type) {
+		case string:
+			text, err := checker.check(content)
+			if err != nil {
+				return err
+			}
+			msg["content"] = text
+		case []any:
+			for _, p := range content {
+				part, _ := p.(map[string]any)
+				if text, ok := part["text"].(string); ok {
+					text, err := checker.check(text)
+					if err != nil {
+						return err
+					}
+					part["text"] = text
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// userContents 返回请求中每条用户消息的文本
+func userContents(messages []any) []string {
+	var texts []string
+	for _, m := range messages {
+		msg, _ := m.(map[string]any)
+		if role, _ := msg["role"].(string); role == "user" {
+			texts = append(texts, contentText(msg["content"]))
+		}
+	}
+	return texts
+}
+
+// lastUserContent 返回请求中最后一条用户消息的文本，审计日志把它作为这一轮的提问
+func lastUserContent(messages []any) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg, _ := messages[i].(map[string]any)
+		if role, _ := msg["role"].(string); role == "user" {
+			return contentText(msg["content"])
+		}
+	}
+	return ""
+}
+
+// contentText 返回消息 content 中的文本，content 可以是字符串或内容片段数组
+func contentText(content any) string {
+	switch content := content.(type) {
+	case string:
+		return content
+	case []any:
+		var parts []string
+		for _, p := range content {
+			part, _ := p.(map[string]any)
+			if text, ok := part["text"].(string); ok {
+				parts = append(parts, text)
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
@@ -0,0 +1,34 @@
+package http
+
+import (
+	"net/http"
+
+	"sshtalk/redact"
+)
+
+// redactedHeader 列出请求中被替换的敏感内容，例如 "2 email, 1 jwt"
+const redactedHeader = "X-Redacted"
+
+// promptChecker 检查一个请求中所有发往模型的消息，汇总命中的规则
+type promptChecker struct {
+	r     *http.Request
+	found redact.Findings
+}
+
+func newPromptChecker(r *http.Request) *promptChecker {
+	return &promptChecker{r: r, found: redact.Findings{}}
+}
+
+// check 返回可以发送的文本。block 模式下命中规则时返回 *redact.BlockedError
+func (c *promptChecker) check(text string) (string, error) {
+	text, found, err := redact.Check(c.r.Context(), text)
+	c.found.Add(found)
+	return text, err
+}
+
+// setHeader 在响应头中列出替换的内容，没有替换时不设置
+func (c *promptChecker) setHeader(w http.ResponseWriter) {
+	if len(c.found) > 0 {
+		w.Header().Set(redactedHeader, c.found.String())
+	}
+}
@@ -3,16 +3,33 @@ package http
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
+
+	"sshtalk/audit"
+	"sshtalk/auth"
+	"sshtalk/drain"
+	"sshtalk/frontend"
+	"sshtalk/mcp"
+	"sshtalk/moderation"
+	"sshtalk/motd"
+	"sshtalk/provider"
+	"sshtalk/redact"
+	"sshtalk/server/admin"
+	"sshtalk/store"
+	"sshtalk/ui"
 )
 
 type Message struct {
@@ -22,14 +39,50 @@ type Message struct {
 
 // Start 启动HTTP服务器
 func Start() {
-	openaiBaseURL := os.Getenv("OPENAI_BASE_URL")
-	openaiAPIKey := os.Getenv("OPENAI_API_KEY")
-	openaiModel := os.Getenv("OPENAI_MODEL")
 	port := os.Getenv("PORT")
 
-	log.Printf("Starting server with OpenAI config - BaseURL: %s, Model: %s", openaiBaseURL, openaiModel)
+	slog.Info("provider configured", "base_url", os.Getenv("OPENAI_BASE_URL"), "model", os.Getenv("OPENAI_MODEL"))
+
+	llm := provider.Default()
+
+	mcpManager := mcp.Shared()
+	chat := &chatService{llm: llm, mcp: mcpManager, tools: mcpManager.OpenAITools()}
 
-	openaiClient := openai.NewClient(option.WithBaseURL(openaiBaseURL), option.WithAPIKey(openaiAPIKey))
+	tokens, err := auth.Default()
+	if err != nil {
+		slog.Error("failed to open token store", "err", err)
+		os.Exit(1)
+	}
+	if _, err := audit.Default(); err != nil {
+		slog.Error("failed to open audit log", "err", err)
+		os.Exit(1)
+	}
+	if _, err := redact.Default(); err != nil {
+		slog.Error("invalid redaction config", "err", err)
+		os.Exit(1)
+	}
+	if _, err := moderation.Default(); err != nil {
+		slog.Error("invalid moderation config", "err", err)
+		os.Exit(1)
+	}
+	timeout, err := drain.Timeout()
+	if err != nil {
+		slog.Error("invalid shutdown config", "err", err)
+		os.Exit(1)
+	}
+	if _, err := provider.StreamLimit(); err != nil {
+		slog.Error("invalid stream limit config", "err", err)
+		os.Exit(1)
+	}
+	if terminalIdleTimeout, terminalMaxSession, err = ui.Timeouts(); err != nil {
+		slog.Error("invalid session timeout config", "err", err)
+		os.Exit(1)
+	}
+	// 网页终端显示与 SSH 相同的欢迎消息
+	if err := motd.Validate(); err != nil {
+		slog.Error("invalid MOTD template", "err", err)
+		os.Exit(1)
+	}
 
 	mux := http.NewServeMux()
 
@@ -57,51 +110,129 @@ func Start() {
 			return
 		}
 
+		checker := newPromptChecker(r)
 		messages := make([]openai.ChatCompletionMessageParamUnion, 0)
+		var prompts []string
 		for _, msg := range data {
+			content, err := checker.check(msg.Content)
+			if err != nil {
+				var blocked *redact.BlockedError
+				if errors.As(err, &blocked) {
+					audit.RecordBlocked(r.Context(), llm.Model, "", err)
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				slog.ErrorContext(r.Context(), "redaction error", "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			msg.Content = content
 			switch msg.Role {
 			case "user":
 				messages = append(messages, openai.UserMessage(msg.Content))
+				prompts = append(prompts, msg.Content)
 			case "assistant":
 				messages = append(messages, openai.AssistantMessage(msg.Content))
 			}
 		}
 
+		notes, err := moderateInput(r.Context(), prompts...)
+		if err != nil {
+			if blocked, ok := asBlocked(err); ok {
+				audit.RecordBlocked(r.Context(), llm.Model, lastUserPrompt(messages), err)
+				writePolicyError(w, blocked)
+				return
+			}
+			if r.Context().Err() == nil {
+				slog.ErrorContext(r.Context(), "moderation error", "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
 		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
 		defer cancel()
 
-		stream := openaiClient.Chat.Completions.NewStreaming(ctx, openai.ChatCompletionNewParams{
-			Model:    openaiModel,
-			Messages: messages,
+		checker.setHeader(w)
+		sse := newSSEWriter(w, flusher)
+		var writeErr error
+		reply, err := chat.complete(ctx, messages, func(content string) error {
+			writeErr = sse.send(eventDelta, deltaEvent{Content: content})
+			return writeErr
 		})
-
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-
-		acc := openai.ChatCompletionAccumulator{}
-		for stream.Next() {
-			chunk := stream.Current()
-			acc.AddChunk(chunk)
-			if len(chunk.Choices) > 0 {
-				if content := chunk.Choices[0].Delta.Content; content != "" {
-					if _, err := w.Write([]byte(content)); err != nil {
-						log.Printf("Error writing response: %v", err)
-						return
-					}
-					flusher.Flush()
-				}
+		if writeErr != nil {
+			slog.DebugContext(r.Context(), "error writing response", "err", writeErr)
+			return
+		}
+		// 响应头已经发出，错误只能作为事件发送
+		if err != nil {
+			if blocked, ok := asBlocked(err); ok {
+				sse.send(eventError, errorEvent{Message: blocked.Error(), Code: codePolicyViolation, Stage: string(blocked.Stage)})
+				return
+			}
+			if drain.Draining() && errors.Is(err, context.Canceled) {
+				sse.send(eventError, errorEvent{Message: "server is shutting down"})
+				return
 			}
+			sse.send(eventError, errorEvent{Message: "upstream model request failed"})
+			return
 		}
 
-		if err := stream.Err(); err != nil {
-			log.Printf("Stream error: %v", err)
+		sse.send(eventUsage, reply.Usage)
+		sse.send(eventDone, doneEvent{FinishReason: reply.FinishReason, Notes: mergeNotes(notes, reply.Notes)})
+	})
+
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query().Get("q")
+		if query == "" {
+			http.Error(w, "Missing q parameter", http.StatusBadRequest)
+			return
+		}
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit <= 0 || limit > 100 {
+			limit = 20
+		}
+
+		st, err := store.Default()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "store error", "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		results, err := st.Search(requestIdentity(r), query, limit)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "search error", "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		if results == nil {
+			results = []store.Result{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
 	})
 
+	admin.Register(mux)
+	mux.HandleFunc("GET /api/ws", chat.serveWS)
+	registerConversationRoutes(mux)
+	registerTerminalRoutes(mux)
+	registerOpenAIRoutes(mux, llm)
+	registerAnnouncementRoutes(mux)
+
 	// Frontend handling
+	var static http.Handler
+	if files := frontend.FS(); files != nil {
+		h, err := newStaticHandler(files)
+		if err != nil {
+			slog.Error("failed to load embedded frontend", "err", err)
+			os.Exit(1)
+		}
+		static = h
+	}
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		isDev := os.Getenv("ENV") == "development"
 		if isDev {
@@ -112,6 +243,10 @@ func Start() {
 			proxy.ServeHTTP(w, r)
 			return
 		}
+		if static != nil && !protected(r.URL.Path) {
+			static.ServeHTTP(w, r)
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Not Found"))
 	})
@@ -119,15 +254,32 @@ func Start() {
 	// Create server with timeouts
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%s", port),
-		Handler:      mux,
+		Handler:      tracingMiddleware(mux, loggingMiddleware(mux, metricsMiddleware(mux, authMiddleware(tokens, mux)))),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 120 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
+	// 请求的 context 在关闭的截止时间取消，进行中的流式响应不会拖住关闭
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+
+	// Handle graceful shutdown
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
+
 	// Start server
-	log.Printf("Server starting on port %s", port)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Server failed to start: %v", err)
-	}
+	slog.Info("starting HTTP server", "addr", srv.Addr)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("server failed to start", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-done
+	shutdown(srv, timeout, cancelRequests, done)
+	// 会话都已结束，不关闭的话 MCP 服务器进程会成为孤儿进程
+	mcp.CloseShared()
 }
@@ -0,0 +1,52 @@
+package http
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"sshtalk/drain"
+)
+
+// activeSessions 跟踪 /api/ws 和网页终端的 WebSocket 会话。
+// http.Server.Shutdown 不等待升级后的连接，关闭时需要单独等待它们
+var activeSessions sync.WaitGroup
+
+// shutdown 停止接受新连接，通知 WebSocket 会话倒计时关闭，等进行中的流式响应结束或到达截止时间。
+// 截止时间到达时取消所有请求的 context，再次收到信号时立即退出
+func shutdown(srv *http.Server, timeout time.Duration, cancelRequests context.CancelFunc, signals <-chan os.Signal) {
+	deadline := time.Now().Add(timeout)
+	slog.Info("stopping HTTP server", "timeout", timeout.String())
+	drain.Start(deadline)
+	go func() {
+		<-signals
+		slog.Warn("second signal received, exiting immediately")
+		os.Exit(1)
+	}()
+
+	stop := time.AfterFunc(timeout, cancelRequests)
+	defer stop.Stop()
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline.Add(drain.Grace))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("closing remaining connections", "err", err)
+		srv.Close()
+	}
+
+	// Shutdown 返回后不会再有新的会话，这里的 Wait 不会与 Add 并发
+	waited := make(chan struct{})
+	go func() {
+		activeSessions.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		slog.Info("HTTP server stopped")
+	case <-ctx.Done():
+		slog.Warn("websocket sessions still open at shutdown")
+	}
+}
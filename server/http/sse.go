@@ -0,0 +1,68 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// SSE 事件类型
+const (
+	eventDelta = "delta" // 增量内容 {"content": "..."}
+	eventUsage = "usage" // token 用量 {"prompt_tokens": 0, "completion_tokens": 0, "total_tokens": 0}
+	eventError = "error" // 错误 {"message": "...", "code": "...", "stage": "..."}
+	eventDone  = "done"  // 结束 {"finish_reason": "...", "notes": [...]}
+)
+
+type deltaEvent struct {
+	Content string `json:"content"`
+}
+
+type usageEvent struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+type errorEvent struct {
+	Message string `json:"message"`
+	// 被审核拒绝时 Code 为 content_policy_violation，Stage 为 input 或 output
+	Code  string `json:"code,omitempty"`
+	Stage string `json:"stage,omitempty"`
+}
+
+type doneEvent struct {
+	FinishReason string   `json:"finish_reason"`
+	Notes        []string `json:"notes,omitempty"` // 审核钩子的提示
+}
+
+// sseWriter 按 text/event-stream 格式写出带 ID 的 JSON 事件
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	id      int
+}
+
+// newSSEWriter 写出 SSE 响应头，之后只能通过事件报告错误
+func newSSEWriter(w http.ResponseWriter, flusher http.Flusher) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return &sseWriter{w: w, flusher: flusher}
+}
+
+// send 写出一个事件并立即刷新
+func (s *sseWriter) send(event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	s.id++
+	if _, err := fmt.Fprintf(s.w, "id: %d\nevent: %s\ndata: %s\n\n", s.id, event, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
@@ -0,0 +1,147 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 带内容哈希的文件名可以永久缓存
+const immutableCache = "public, max-age=31536000, immutable"
+
+// staticFile 是预先读取并计算好 ETag 的嵌入文件
+type staticFile struct {
+	data        []byte
+	etag        string
+	contentType string
+	// 预压缩的版本，按 Content-Encoding 索引
+	encoded map[string][]byte
+}
+
+// staticHandler 提供嵌入的前端文件：优先返回预压缩的 br/gz 版本，找不到的页面回退到 index.html
+type staticHandler struct {
+	files map[string]*staticFile
+}
+
+// 预压缩版本的扩展名，按优先级排列
+var encodings = []struct{ name, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// newStaticHandler 读取 files 中的所有文件
+func newStaticHandler(files fs.FS) (*staticHandler, error) {
+	h := &staticHandler{files: map[string]*staticFile{}}
+	err := fs.WalkDir(files, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		for _, e := range encodings {
+			if strings.HasSuffix(name, e.ext) {
+				return nil
+			}
+		}
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		f := &staticFile{
+			data:        data,
+			etag:        `"` + hex.EncodeToString(sum[:8]) + `"`,
+			contentType: mime.TypeByExtension(path.Ext(name)),
+			encoded:     map[string][]byte{},
+		}
+		if f.contentType == "" {
+			f.contentType = http.DetectContentType(data)
+		}
+		for _, e := range encodings {
+			if encoded, err := fs.ReadFile(files, name+e.ext); err == nil {
+				f.encoded[e.name] = encoded
+			}
+		}
+		h.files["/"+name] = f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if h.files["/index.html"] == nil {
+		slog.Warn("embedded frontend has no index.html")
+	}
+	return h, nil
+}
+
+// acceptsEncoding 判断客户端是否接受指定的压缩格式
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	f, ok := h.files[name]
+	if !ok {
+		f, ok = h.files[name+"/index.html"]
+	}
+	if !ok {
+		// 有扩展名的路径是缺失的静态资源，其余交给前端路由处理
+		if path.Ext(name) != "" {
+			http.NotFound(w, r)
+			return
+		}
+		if f, ok = h.files["/index.html"]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		name = "/index.html"
+	}
+
+	header := w.Header()
+	if strings.HasPrefix(name, "/assets/") {
+		header.Set("Cache-Control", immutableCache)
+	} else {
+		header.Set("Cache-Control", "no-cache")
+	}
+	header.Set("Content-Type", f.contentType)
+	header.Set("Vary", "Accept-Encoding")
+
+	data, etag := f.data, f.etag
+	for _, e := range encodings {
+		if encoded, ok := f.encoded[e.name]; ok && acceptsEncoding(r, e.name) {
+			header.Set("Content-Encoding", e.name)
+			data = encoded
+			etag = strings.TrimSuffix(etag, `"`) + "-" + e.name + `"`
+			break
+		}
+	}
+	header.Set("ETag", etag)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
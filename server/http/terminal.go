@@ -0,0 +1,176 @@
+package http
+
+import (
+	"context"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/gorilla/websocket"
+
+	"sshtalk/audit"
+	"sshtalk/auth"
+	"sshtalk/drain"
+	"sshtalk/ui"
+)
+
+//go:embed terminal.html
+var terminalPage []byte
+
+// 网页终端允许的最大窗口尺寸，防止异常的 resize 消息
+const maxTerminalSize = 1000
+
+// 网页终端的空闲超时和最长时间，与 SSH 会话使用相同的配置，为 0 时不限制
+var (
+	terminalIdleTimeout time.Duration
+	terminalMaxSession  time.Duration
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// terminalMessage 是浏览器发来的消息：input 为键盘输入，resize 为窗口大小变化
+type terminalMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+}
+
+// terminalConn 把 WebSocket 连接当作虚拟终端：输出以二进制帧发送，其他通知以 JSON 文本帧发送
+type terminalConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// Write 实现 io.Writer，bubbletea 的渲染输出写到这里
+func (t *terminalConn) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *terminalConn) sendJSON(v any) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn.WriteJSON(v)
+}
+
+func (t *terminalConn) close(code int, text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+	t.conn.Close()
+}
+
+// download 把 /export 的文件发给浏览器下载
+func (t *terminalConn) download(name string, data []byte) (string, error) {
+	err := t.sendJSON(map[string]string{
+		"type": "download",
+		"name": name,
+		"data": base64.StdEncoding.EncodeToString(data),
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Downloading %s", name), nil
+}
+
+// registerTerminalRoutes 注册网页终端：/terminal 是 xterm.js 页面，/api/terminal 是运行 TUI 的 WebSocket
+func registerTerminalRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /terminal", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(terminalPage)
+	})
+	mux.HandleFunc("GET /api/terminal", serveTerminal)
+}
+
+// serveTerminal 为每个连接启动一个与 SSH 会话相同的 bubbletea 程序。
+// 服务器关闭时由 TUI 显示倒计时并自行退出
+func serveTerminal(w http.ResponseWriter, r *http.Request) {
+	activeSessions.Add(1)
+	defer activeSessions.Done()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "websocket upgrade failed", "err", err)
+		return
+	}
+	term := &terminalConn{conn: conn}
+
+	// 程序在连接断开前一直运行，只保留请求 context 中的日志字段和令牌
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+
+	t, _ := auth.FromContext(r.Context())
+	actor, _ := audit.ActorFrom(ctx)
+	actor.Source = "terminal"
+	actor.User = t.Name
+	ctx = audit.WithActor(ctx, actor)
+	m := ui.NewModel(ui.Options{
+		Context:     ctx,
+		Identity:    t.Owner,
+		User:        t.Name,
+		Export:      term.download,
+		IdleTimeout: terminalIdleTimeout,
+		MaxDuration: terminalMaxSession,
+	})
+	defer m.Close()
+
+	input, inputWriter := io.Pipe()
+	p := tea.NewProgram(&m,
+		tea.WithContext(ctx),
+		tea.WithInput(input),
+		tea.WithOutput(term),
+		tea.WithAltScreen(),
+		tea.WithMouseCellMotion(),
+		tea.WithoutSignalHandler(),
+	)
+
+	// 读取浏览器消息，连接断开时结束程序
+	go func() {
+		defer cancel()
+		defer inputWriter.Close()
+		for {
+			var msg terminalMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			switch msg.Type {
+			case "input":
+				if _, err := io.WriteString(inputWriter, msg.Data); err != nil {
+					return
+				}
+			case "resize":
+				if msg.Cols > 0 && msg.Rows > 0 && msg.Cols <= maxTerminalSize && msg.Rows <= maxTerminalSize {
+					p.Send(tea.WindowSizeMsg{Width: msg.Cols, Height: msg.Rows})
+				}
+			}
+		}
+	}()
+
+	slog.InfoContext(ctx, "web terminal started", "token", t.Name, "identity", t.Owner)
+	start := time.Now()
+	if _, err := p.Run(); err != nil && ctx.Err() == nil {
+		slog.ErrorContext(ctx, "web terminal error", "err", err)
+	}
+	input.Close()
+	if drain.Draining() {
+		term.close(websocket.CloseGoingAway, "server shutting down")
+	} else {
+		term.close(websocket.CloseNormalClosure, "session ended")
+	}
+	slog.InfoContext(ctx, "web terminal closed", "duration_ms", time.Since(start).Milliseconds())
+}
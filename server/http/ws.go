@@ -0,0 +1,429 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/openai/openai-go"
+
+	"sshtalk/audit"
+	"sshtalk/auth"
+	"sshtalk/conversation"
+	"sshtalk/drain"
+	"sshtalk/moderation"
+	"sshtalk/provider"
+	"sshtalk/redact"
+	"sshtalk/store"
+)
+
+// /api/ws 消息类型
+const (
+	// 客户端发送
+	wsSend       = "send"       // 发送用户消息并生成回复 {"content": "..."}
+	wsCancel     = "cancel"     // 取消正在生成的回复
+	wsRegenerate = "regenerate" // 丢弃最后一条回复并重新生成
+	wsOpen       = "open"       // 继续保存的对话 {"conversation_id": "..."}
+
+	// 服务端发送
+	wsTyping  = "typing"  // 开始生成回复
+	wsDelta   = "delta"   // 增量内容 {"content": "..."}
+	wsDone    = "done"    // 回复结束 {"finish_reason", "usage", "conversation_id", "notes"}
+	wsError   = "error"   // 错误 {"message": "..."}，被审核拒绝时还有 {"code", "stage"}
+	wsHistory = "history" // open 的结果，保存时合并了其他会话的修改也会发送 {"conversation_id", "messages"}
+	// 用户消息中的敏感内容已被替换 {"message": "1 email", "content": 实际发送的内容}
+	wsRedacted = "redacted"
+	// 服务器正在关闭 {"message", "deadline"}，正在生成的回复在 deadline 前结束，之后连接关闭
+	wsShutdown = "shutdown"
+)
+
+// 取消时的结束原因
+const finishCancelled = "cancelled"
+
+// wsClientMessage 是客户端发来的消息
+type wsClientMessage struct {
+	Type           string `json:"type"`
+	Content        string `json:"content,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"`
+}
+
+// wsServerMessage 是发给客户端的消息，按类型只填写相关字段
+type wsServerMessage struct {
+	Type           string                 `json:"type"`
+	Content        string                 `json:"content,omitempty"`
+	Message        string                 `json:"message,omitempty"`
+	FinishReason   string                 `json:"finish_reason,omitempty"`
+	Usage          *usageEvent            `json:"usage,omitempty"`
+	ConversationID string                 `json:"conversation_id,omitempty"`
+	Messages       []conversation.Message `json:"messages,omitempty"`
+	Code           string                 `json:"code,omitempty"`
+	Stage          string                 `json:"stage,omitempty"`
+	Notes          []string               `json:"notes,omitempty"`
+	Deadline       *time.Time             `json:"deadline,omitempty"`
+}
+
+// wsSession 是一个 WebSocket 连接上的多轮对话，同一时间最多生成一条回复
+type wsSession struct {
+	chat  *chatService
+	owner string
+	ctx   context.Context
+
+	writeMu sync.Mutex
+	conn    *websocket.Conn
+
+	mu     sync.Mutex
+	conv   conversation.Conversation
+	saved  int                // conv 中已经保存的消息数，之后的消息是本会话新增的
+	cancel context.CancelFunc // 正在生成回复时不为 nil
+}
+
+func (s *wsSession) send(msg wsServerMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteJSON(msg)
+}
+
+func (s *wsSession) sendError(message string) {
+	s.send(wsServerMessage{Type: wsError, Message: message})
+}
+
+// sendBlocked 报告被审核钩子拒绝的消息或回复
+func (s *wsSession) sendBlocked(b *moderation.BlockedError) {
+	s.send(wsServerMessage{Type: wsError, Message: b.Error(), Code: codePolicyViolation, Stage: string(b.Stage)})
+}
+
+// serveWS 处理 /api/ws，连接断开时取消正在进行的上游请求
+func (c *chatService) serveWS(w http.ResponseWriter, r *http.Request) {
+	activeSessions.Add(1)
+	defer activeSessions.Done()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "websocket upgrade failed", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	// 会话在连接断开前一直有效，只保留请求 context 中的日志字段和令牌
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+
+	t, _ := auth.FromContext(r.Context())
+	s := &wsSession{
+		chat:  c,
+		owner: t.Owner,
+		ctx:   ctx,
+		conn:  conn,
+		conv:  conversation.Conversation{Created: time.Now()},
+	}
+	go s.drain()
+
+	for {
+		var msg wsClientMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) && !drain.Draining() {
+				slog.WarnContext(ctx, "websocket read error", "err", err)
+			}
+			return
+		}
+		s.handle(msg)
+	}
+}
+
+func (s *wsSession) handle(msg wsClientMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch msg.Type {
+	case wsCancel:
+		if s.cancel != nil {
+			s.cancel()
+		}
+		return
+	case wsSend, wsRegenerate, wsOpen:
+		if s.cancel != nil {
+			s.sendError("A reply is already being generated, cancel it first")
+			return
+		}
+		if drain.Draining() {
+			s.sendError("Server is shutting down")
+			return
+		}
+	default:
+		s.sendError("Unknown message type " + msg.Type)
+		return
+	}
+
+	switch msg.Type {
+	case wsSend:
+		content := strings.TrimSpace(msg.Content)
+		if content == "" {
+			s.sendError("content is required")
+			return
+		}
+		content, found, err := redact.Check(s.ctx, content)
+		if err != nil {
+			var blocked *redact.BlockedError
+			if errors.As(err, &blocked) {
+				audit.RecordBlocked(s.ctx, s.chat.llm.Model, "", err)
+				s.sendError(err.Error())
+			} else {
+				slog.ErrorContext(s.ctx, "redaction error", "err", err)
+				s.sendError("Internal server error")
+			}
+			return
+		}
+		if len(found) > 0 {
+			s.send(wsServerMessage{Type: wsRedacted, Message: found.String(), Content: content})
+		}
+		s.moderate(content)
+	case wsRegenerate:
+		n := len(s.conv.Messages)
+		for n > 0 && s.conv.Messages[n-1].Role == conversation.RoleAssistant {
+			n--
+		}
+		if n == 0 || s.conv.Messages[n-1].Role != conversation.RoleUser {
+			s.sendError("Nothing to regenerate")
+			return
+		}
+		s.conv.Messages = s.conv.Messages[:n]
+		s.saved = min(s.saved, n)
+		ctx, cancel := s.startReply()
+		s.generate(ctx, cancel, nil)
+	case wsOpen:
+		s.open(msg.ConversationID)
+	}
+}
+
+// open 载入属于当前身份的对话，之后的消息追加到这段对话
+func (s *wsSession) open(id string) {
+	st, err := store.Default()
+	if err != nil {
+		slog.ErrorContext(s.ctx, "store error", "err", err)
+		s.sendError("Internal server error")
+		return
+	}
+	c, err := st.Get(id)
+	if err != nil || c.Owner != s.owner {
+		s.sendError("Conversation not found")
+		return
+	}
+	s.conv = c
+	s.saved = len(c.Messages)
+	s.send(wsServerMessage{Type: wsHistory, ConversationID: c.ID, Messages: c.Messages})
+}
+
+// history 把对话转换为请求消息，工具消息没有保存调用 ID，不放入历史。
+// 打开的对话可能来自导入或 HTTP 接口，没有经过输入时的检查，返回前检查全部消息
+func (s *wsSession) history() ([]openai.ChatCompletionMessageParamUnion, error) {
+	messages := []openai.ChatCompletionMessageParamUnion{openai.SystemMessage(provider.SystemPrompt)}
+	for _, m := range s.conv.Messages {
+		switch m.Role {
+		case conversation.RoleUser:
+			messages = append(messages, openai.UserMessage(m.Content))
+		case conversation.RoleAssistant:
+			messages = append(messages, openai.AssistantMessage(m.Content))
+		}
+	}
+	messages, _, err := redact.CheckMessages(s.ctx, messages)
+	return messages, err
+}
+
+// startReply 开始新的一轮回复，之后到回复结束前 cancel 消息会取消它。调用者需持有 s.mu
+func (s *wsSession) startReply() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(s.ctx, 2*time.Minute)
+	s.cancel = cancel
+	return ctx, cancel
+}
+
+// moderate 在后台用审核钩子检查用户消息，通过后把消息加入对话并生成回复。
+// 外部钩子可能需要几秒，检查期间不持有 s.mu，也不阻塞读取连接，客户端可以取消。调用者需持有 s.mu
+func (s *wsSession) moderate(content string) {
+	ctx, cancel := s.startReply()
+	go func() {
+		notes, err := moderateInput(ctx, content)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err == nil && ctx.Err() == nil {
+			s.conv.Messages = append(s.conv.Messages, conversation.Message{
+				Role:    conversation.RoleUser,
+				Content: content,
+				Time:    time.Now(),
+			})
+			s.generate(ctx, cancel, notes)
+			return
+		}
+
+		cancel()
+		s.cancel = nil
+		blocked, isBlocked := asBlocked(err)
+		if isBlocked {
+			audit.RecordBlocked(s.ctx, s.chat.llm.Model, content, err)
+		}
+		if s.ctx.Err() != nil {
+			// 连接已经断开
+			return
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		if drain.Draining() {
+			defer s.close()
+		}
+		if isBlocked {
+			s.sendBlocked(blocked)
+			return
+		}
+		if errors.Is(ctx.Err(), context.Canceled) {
+			// 在审核期间取消，消息不加入对话
+			s.send(wsServerMessage{Type: wsDone, FinishReason: finishCancelled, ConversationID: s.conv.ID})
+			return
+		}
+		slog.ErrorContext(s.ctx, "moderation error", "err", err)
+		s.sendError("Internal server error")
+	}()
+}
+
+// generate 在后台生成回复，ctx 和 cancel 来自 startReply，notes 是审核钩子对用户消息的提示，随 done 一起发出。
+// 调用者需持有 s.mu
+func (s *wsSession) generate(ctx context.Context, cancel context.CancelFunc, notes []string) {
+	messages, err := s.history()
+	if err != nil {
+		cancel()
+		s.cancel = nil
+		var blocked *redact.BlockedError
+		if errors.As(err, &blocked) {
+			audit.RecordBlocked(s.ctx, s.chat.llm.Model, "", err)
+			s.sendError(err.Error())
+		} else {
+			slog.ErrorContext(s.ctx, "redaction error", "err", err)
+			s.sendError("Internal server error")
+		}
+		return
+	}
+	s.send(wsServerMessage{Type: wsTyping})
+
+	go func() {
+		defer cancel()
+		reply, err := s.chat.complete(ctx, messages, func(content string) error {
+			return s.send(wsServerMessage{Type: wsDelta, Content: content})
+		})
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cancel = nil
+		if s.ctx.Err() != nil {
+			// 连接已经断开
+			return
+		}
+		// 服务器正在关闭时，回复结束后关闭连接
+		if drain.Draining() {
+			defer s.close()
+		}
+
+		cancelled := errors.Is(ctx.Err(), context.Canceled)
+		if err != nil && !cancelled {
+			// 被拒绝的回复不保存，客户端应丢弃已经收到的部分
+			if blocked, ok := asBlocked(err); ok {
+				s.sendBlocked(blocked)
+				return
+			}
+			s.sendError("upstream model request failed")
+			return
+		}
+		if cancelled {
+			reply.FinishReason = finishCancelled
+		}
+		// 取消时保留已经生成的部分
+		if reply.Content != "" {
+			s.conv.Messages = append(s.conv.Messages, conversation.Message{
+				Role:             conversation.RoleAssistant,
+				Content:          reply.Content,
+				Time:             time.Now(),
+				Model:            s.chat.llm.Model,
+				PromptTokens:     reply.Usage.PromptTokens,
+				CompletionTokens: reply.Usage.CompletionTokens,
+			})
+		}
+		s.save()
+		s.send(wsServerMessage{
+			Type:           wsDone,
+			FinishReason:   reply.FinishReason,
+			Usage:          &reply.Usage,
+			ConversationID: s.conv.ID,
+			Notes:          mergeNotes(notes, reply.Notes),
+		})
+	}()
+}
+
+// drain 在服务器关闭时通知客户端。没有正在生成的回复时立即关闭连接，
+// 否则等回复结束；到达截止时间时取消回复，已经生成的部分会被保存
+func (s *wsSession) drain() {
+	select {
+	case <-drain.Started():
+	case <-s.ctx.Done():
+		return
+	}
+	deadline := drain.Deadline()
+
+	s.mu.Lock()
+	s.send(wsServerMessage{Type: wsShutdown, Message: "Server is shutting down", Deadline: &deadline})
+	idle := s.cancel == nil
+	s.mu.Unlock()
+	if idle {
+		s.close()
+		return
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		s.mu.Lock()
+		if s.cancel != nil {
+			s.cancel()
+		}
+		s.mu.Unlock()
+	case <-s.ctx.Done():
+	}
+}
+
+// close 以 going away 关闭连接，客户端可以重新连接到其他实例
+func (s *wsSession) close() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	s.conn.Close()
+}
+
+// save 把对话保存到存储，与 SSH 会话和 /api/conversations 共享
+func (s *wsSession) save() {
+	if s.owner == "" {
+		return
+	}
+	st, err := store.Default()
+	if err != nil {
+		slog.ErrorContext(s.ctx, "store error", "err", err)
+		return
+	}
+	s.conv.Owner = s.owner
+	if s.conv.Model == "" {
+		s.conv.Model = s.chat.llm.Model
+	}
+	merged, err := st.SaveMerged(&s.conv, s.conv.Updated, s.saved)
+	if err != nil {
+		slog.ErrorContext(s.ctx, "failed to save conversation", "err", err)
+		return
+	}
+	s.saved = len(s.conv.Messages)
+	if merged {
+		// 其他会话在此期间修改了对话，客户端需要显示合并后的对话
+		s.send(wsServerMessage{Type: wsHistory, ConversationID: s.conv.ID, Messages: s.conv.Messages})
+	}
+}
@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+
+	"sshtalk/metrics"
+)
+
+// sessionLimits 限制同时连接的会话数，上限为 0 时不限制
+type sessionLimits struct {
+	total       int
+	perIdentity int
+	perIP       int
+
+	mu         sync.Mutex
+	count      int
+	identities map[string]int
+	ips        map[string]int
+}
+
+var limits = &sessionLimits{identities: map[string]int{}, ips: map[string]int{}}
+
+// loadLimits 读取 SSHTALK_MAX_SESSIONS、SSHTALK_MAX_SESSIONS_PER_IDENTITY 和 SSHTALK_MAX_SESSIONS_PER_IP
+func loadLimits() error {
+	var err error
+	if limits.total, err = intEnv("SSHTALK_MAX_SESSIONS"); err != nil {
+		return err
+	}
+	if limits.perIdentity, err = intEnv("SSHTALK_MAX_SESSIONS_PER_IDENTITY"); err != nil {
+		return err
+	}
+	limits.perIP, err = intEnv("SSHTALK_MAX_SESSIONS_PER_IP")
+	return err
+}
+
+func intEnv(name string) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// acquire 在没有超过上限时登记会话，否则返回超过的上限：total、identity 或 ip。
+// 没有公钥的会话身份为空，只受总数和来源地址的限制
+func (l *sessionLimits) acquire(identity, ip string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.total > 0 && l.count >= l.total:
+		return "total", false
+	case l.perIdentity > 0 && identity != "" && l.identities[identity] >= l.perIdentity:
+		return "identity", false
+	case l.perIP > 0 && l.ips[ip] >= l.perIP:
+		return "ip", false
+	}
+	l.count++
+	if identity != "" {
+		l.identities[identity]++
+	}
+	l.ips[ip]++
+	return "", true
+}
+
+func (l *sessionLimits) release(identity, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count--
+	if identity != "" {
+		if l.identities[identity]--; l.identities[identity] == 0 {
+			delete(l.identities, identity)
+		}
+	}
+	if l.ips[ip]--; l.ips[ip] == 0 {
+		delete(l.ips, ip)
+	}
+}
+
+// rejection 返回超过上限时显示给用户的提示
+func (l *sessionLimits) rejection(limit string) string {
+	switch limit {
+	case "identity":
+		return fmt.Sprintf("Too many sessions for this key (at most %d). Close one and try again.", l.perIdentity)
+	case "ip":
+		return fmt.Sprintf("Too many sessions from your address (at most %d). Close one and try again.", l.perIP)
+	}
+	return "The server is full. Try again later."
+}
+
+// limitMiddleware 拒绝超过会话数上限的连接
+func limitMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		identity, ip := Identity(s), remoteIP(s)
+		limit, ok := limits.acquire(identity, ip)
+		if !ok {
+			metrics.SSHSessionsRejected.WithLabelValues(limit).Inc()
+			slog.WarnContext(sessionContext(s), "session rejected", "limit", limit, "remote_ip", ip)
+			wish.Fatalln(s, limits.rejection(limit))
+			return
+		}
+		defer limits.release(identity, ip)
+		next(s)
+	}
+}
+
+func remoteIP(s ssh.Session) string {
+	host, _, err := net.SplitHostPort(s.RemoteAddr().String())
+	if err != nil {
+		return s.RemoteAddr().String()
+	}
+	return host
+}
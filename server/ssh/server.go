@@ -1,14 +1,30 @@
 package ssh
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"sshtalk/audit"
+	"sshtalk/drain"
+	"sshtalk/hostkey"
+	"sshtalk/logger"
+	"sshtalk/mcp"
+	"sshtalk/metrics"
+	"sshtalk/moderation"
+	"sshtalk/motd"
+	"sshtalk/provider"
+	"sshtalk/redact"
+	"sshtalk/server/admin"
+	"sshtalk/share"
+	"sshtalk/tracing"
 	"sshtalk/ui"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -16,44 +32,173 @@ import (
 	"github.com/charmbracelet/wish"
 	"github.com/charmbracelet/wish/activeterm"
 	"github.com/charmbracelet/wish/bubbletea"
-	"github.com/charmbracelet/wish/logging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 // Start 启动SSH服务器
 func Start() {
+	keys, err := hostKeys()
+	if err != nil {
+		slog.Error("failed to load SSH host keys", "err", err)
+		os.Exit(1)
+	}
+	if err := loadTimeouts(); err != nil {
+		slog.Error("invalid session timeout config", "err", err)
+		os.Exit(1)
+	}
+	if err := motd.Validate(); err != nil {
+		slog.Error("invalid banner or MOTD template", "err", err)
+		os.Exit(1)
+	}
+	if err := loadLimits(); err != nil {
+		slog.Error("invalid session limit config", "err", err)
+		os.Exit(1)
+	}
+	if _, err := provider.StreamLimit(); err != nil {
+		slog.Error("invalid stream limit config", "err", err)
+		os.Exit(1)
+	}
+
 	// Setup SSH server
 	s, err := wish.NewServer(
 		wish.WithAddress(fmt.Sprintf(":%s", os.Getenv("PORT"))),
-		wish.WithHostKeyPath(".ssh/id_ed25519"),
+		withHostKeys(keys),
+		// 横幅在认证前显示，每次连接时重新渲染
+		wish.WithBannerHandler(func(ctx ssh.Context) string {
+			return motd.Banner(motd.Data{User: ctx.User(), Model: provider.Default().Model})
+		}),
+		// 接受任何公钥，公钥指纹作为用户身份；没有公钥的用户也可以登录，但不保存历史
+		wish.WithPublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool { return true }),
+		wish.WithKeyboardInteractiveAuth(func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool { return true }),
 		wish.WithMiddleware(
+			exportMiddleware,
 			bubbletea.Middleware(teaHandler),
 			activeterm.Middleware(), // Bubble Tea apps usually require a PTY
-			logging.Middleware(),    // Add logging
+			limitMiddleware,
+			tracingMiddleware,
+			loggingMiddleware,
+			metricsMiddleware,
 		),
+		withMaxSession(maxSession),
 	)
 	if err != nil {
-		log.Fatalf("Failed to create SSH server: %v", err)
+		slog.Error("failed to create SSH server", "err", err)
+		os.Exit(1)
+	}
+	if _, err := audit.Default(); err != nil {
+		slog.Error("failed to open audit log", "err", err)
+		os.Exit(1)
+	}
+	if _, err := redact.Default(); err != nil {
+		slog.Error("invalid redaction config", "err", err)
+		os.Exit(1)
+	}
+	if _, err := moderation.Default(); err != nil {
+		slog.Error("invalid moderation config", "err", err)
+		os.Exit(1)
+	}
+
+	// SSH 服务器没有 HTTP 接口，设置 SSHTALK_ADMIN_ADDR 后单独提供健康检查和指标
+	if addr := os.Getenv("SSHTALK_ADMIN_ADDR"); addr != "" {
+		admin.Start(addr)
+	}
+
+	timeout, err := drain.Timeout()
+	if err != nil {
+		slog.Error("invalid shutdown config", "err", err)
+		os.Exit(1)
 	}
 
 	// Handle graceful shutdown
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	log.Printf("Starting SSH server on %s", s.Addr)
+	slog.Info("starting SSH server", "addr", s.Addr)
 
 	go func() {
 		if err = s.ListenAndServe(); err != nil && err != ssh.ErrServerClosed {
-			log.Fatalf("SSH server error: %v", err)
+			slog.Error("SSH server error", "err", err)
+			os.Exit(1)
 		}
 	}()
 
 	<-done
-	log.Println("Stopping SSH server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	shutdown(s, timeout, done)
+	// 会话都已结束，不关闭的话 MCP 服务器进程会成为孤儿进程
+	mcp.CloseShared()
+}
+
+// shutdown 停止接受新连接，通知所有会话倒计时关闭，等进行中的回复生成完或到达截止时间。
+// 再次收到信号时立即退出
+func shutdown(s *ssh.Server, timeout time.Duration, signals <-chan os.Signal) {
+	deadline := time.Now().Add(timeout)
+	slog.Info("stopping SSH server", "sessions", sessionCount(), "timeout", timeout.String())
+	drain.Start(deadline)
+	go func() {
+		<-signals
+		slog.Warn("second signal received, exiting immediately")
+		os.Exit(1)
+	}()
 
+	// 会话在截止时间自行保存并退出，之后再留一点时间断开连接
+	ctx, cancel := context.WithDeadline(context.Background(), deadline.Add(drain.Grace))
+	defer cancel()
 	if err := s.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		slog.Warn("closing remaining sessions", "sessions", sessionCount(), "err", err)
+		s.Close()
+		return
 	}
+	slog.Info("SSH server stopped")
+}
+
+// hostKeys 读取主机密钥，第一次启动时生成
+func hostKeys() ([]hostkey.Key, error) {
+	dir, err := hostkey.Dir()
+	if err != nil {
+		return nil, err
+	}
+	types, err := hostkey.Types()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := hostkey.Ensure(dir, types)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys in %s", dir)
+	}
+	for _, k := range keys {
+		slog.Info("using SSH host key", "path", k.Path, "fingerprint", k.Fingerprint())
+	}
+	return keys, nil
+}
+
+// withHostKeys 把所有主机密钥提供给客户端，由客户端选择支持的类型
+func withHostKeys(keys []hostkey.Key) ssh.Option {
+	return func(s *ssh.Server) error {
+		for _, k := range keys {
+			s.AddHostKey(k.Signer)
+		}
+		return nil
+	}
+}
+
+// withMaxSession 在 TUI 没有按时退出时强制断开超过最长时间的连接
+func withMaxSession(d time.Duration) ssh.Option {
+	if d == 0 {
+		return func(*ssh.Server) error { return nil }
+	}
+	return wish.WithMaxTimeout(d + maxSessionGrace)
+}
+
+// Identity 返回会话的身份：公钥指纹，没有公钥时为空
+func Identity(s ssh.Session) string {
+	if key := s.PublicKey(); key != nil {
+		return "key:" + gossh.FingerprintSHA256(key)
+	}
+	return ""
 }
 
 // teaHandler creates a new bubbletea program for each SSH session
@@ -64,10 +209,160 @@ func teaHandler(s ssh.Session) (tea.Model, []tea.ProgramOption) {
 		return nil, nil
 	}
 
-	m := ui.NewModel()
+	exports := &pendingExports{}
+	s.Context().SetValue(exportsKey{}, exports)
+
+	opts := ui.Options{
+		Context:     sessionContext(s),
+		Identity:    Identity(s),
+		User:        s.User(),
+		AllowTokens: true,
+		Export:      exports.add,
+		IdleTimeout: idleTimeout,
+		MaxDuration: maxSession,
+	}
+	if cmd := s.Command(); len(cmd) == 2 {
+		switch cmd[0] {
+		case "room":
+			// ssh -t host room <name> 直接进入聊天室
+			opts.Room = cmd[1]
+		case "watch":
+			// ssh -t host watch <code> 观看分享的会话
+			opts.Watch = cmd[1]
+		}
+	}
+	// 也可以直接用分享码作为用户名登录：ssh <code>@host
+	if _, ok := share.Lookup(s.User()); ok {
+		opts.Watch = s.User()
+	}
+
+	m := ui.NewModel(opts)
+	go func() {
+		<-s.Context().Done()
+		m.Close()
+	}()
 
 	return &m, []tea.ProgramOption{
 		tea.WithAltScreen(),
 		tea.WithMouseCellMotion(),
+		// 退出信号由服务器处理，会话按关闭倒计时退出
+		tea.WithoutSignalHandler(),
+	}
+}
+
+type (
+	sessionIDKey   struct{}
+	sessionSpanKey struct{}
+)
+
+// sessionContext 返回带有会话 ID、会话 span 和用户信息的 context，会话中的模型请求用它记录日志、链路和审计
+func sessionContext(s ssh.Session) context.Context {
+	id, _ := s.Context().Value(sessionIDKey{}).(string)
+	ctx := logger.With(s.Context(), slog.String("session_id", id))
+	ctx = audit.WithActor(ctx, audit.Actor{
+		Source:     "ssh",
+		Identity:   Identity(s),
+		User:       s.User(),
+		RemoteAddr: s.RemoteAddr().String(),
+	})
+	if span, ok := s.Context().Value(sessionSpanKey{}).(trace.Span); ok {
+		ctx = trace.ContextWithSpan(ctx, span)
+	}
+	return ctx
+}
+
+// tracingMiddleware 创建覆盖整个会话的 span，会话中的对话和模型请求都是它的子 span
+func tracingMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		id, _ := s.Context().Value(sessionIDKey{}).(string)
+		_, span := tracing.Tracer().Start(s.Context(), "ssh session",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("sshtalk.session_id", id),
+				attribute.String("sshtalk.user", s.User()),
+				attribute.String("sshtalk.identity", Identity(s)),
+				attribute.String("client.address", s.RemoteAddr().String()),
+				attribute.StringSlice("sshtalk.command", s.Command()),
+			),
+		)
+		defer span.End()
+		s.Context().SetValue(sessionSpanKey{}, span)
+		next(s)
+	}
+}
+
+// loggingMiddleware 为每个会话分配 ID，并记录会话的开始和结束
+func loggingMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		s.Context().SetValue(sessionIDKey{}, logger.NewID())
+		ctx := sessionContext(s)
+		pty, _, _ := s.Pty()
+		slog.InfoContext(ctx, "session started",
+			"user", s.User(),
+			"identity", Identity(s),
+			"remote_addr", s.RemoteAddr().String(),
+			"command", s.Command(),
+			"term", pty.Term,
+		)
+		start := time.Now()
+		next(s)
+		slog.InfoContext(ctx, "session ended", "duration_ms", time.Since(start).Milliseconds())
+	}
+}
+
+// activeSessions 是当前连接的会话数，关闭服务器时记录到日志
+var activeSessions atomic.Int64
+
+func sessionCount() int64 {
+	return activeSessions.Load()
+}
+
+// metricsMiddleware 统计当前连接的会话数
+func metricsMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		metrics.SSHSessions.Inc()
+		metrics.SSHSessionsTotal.Inc()
+		activeSessions.Add(1)
+		defer metrics.SSHSessions.Dec()
+		defer activeSessions.Add(-1)
+		next(s)
+	}
+}
+
+type exportsKey struct{}
+
+// pendingExports 暂存 /export 生成的文件，等退出全屏界面后再输出到终端
+type pendingExports struct {
+	mu    sync.Mutex
+	files []exportFile
+}
+
+type exportFile struct {
+	name string
+	data []byte
+}
+
+func (e *pendingExports) add(name string, data []byte) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.files = append(e.files, exportFile{name: name, data: data})
+	return fmt.Sprintf("%s will be printed when you exit", name), nil
+}
+
+// exportMiddleware 在 bubbletea 程序退出后把导出的文件打印到会话中，
+// 用户可以用 ssh -t host > file 或复制终端内容保存
+func exportMiddleware(next ssh.Handler) ssh.Handler {
+	return func(s ssh.Session) {
+		exports, ok := s.Context().Value(exportsKey{}).(*pendingExports)
+		if ok {
+			exports.mu.Lock()
+			for _, f := range exports.files {
+				fmt.Fprintf(s, "----- %s -----\r\n", f.name)
+				s.Write(bytes.ReplaceAll(f.data, []byte("\n"), []byte("\r\n")))
+				fmt.Fprint(s, "\r\n")
+			}
+			exports.mu.Unlock()
+		}
+		next(s)
 	}
 }
@@ -0,0 +1,23 @@
+package ssh
+
+import (
+	"time"
+
+	"sshtalk/ui"
+)
+
+// 达到最长时间后，TUI 保存对话并退出；连接在此之后还没关闭时强制断开
+const maxSessionGrace = time.Minute
+
+// 会话的空闲超时和最长时间，为 0 时不限制
+var (
+	idleTimeout time.Duration
+	maxSession  time.Duration
+)
+
+// loadTimeouts 读取 SSHTALK_IDLE_TIMEOUT 和 SSHTALK_MAX_SESSION
+func loadTimeouts() error {
+	var err error
+	idleTimeout, maxSession, err = ui.Timeouts()
+	return err
+}
@@ -0,0 +1,204 @@
+package share
+
+import (
+	"crypto/rand"
+	"sync"
+)
+
+// 分享码使用的字符，去掉了容易混淆的 0/O、1/I/L
+const codeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// 分享码长度
+const codeLength = 6
+
+// Message 是分享给观看者的一条消息
+type Message struct {
+	Content  string
+	FromUser bool
+	From     string
+}
+
+// Snapshot 是分享会话在某一时刻的完整状态
+type Snapshot struct {
+	Messages []Message
+	Waiting  bool // 是否正在等待模型回复
+	Done     bool // 最后一条消息是否已生成完毕
+	Writable bool // 观看者是否可以输入
+	Closed   bool // 分享已结束
+}
+
+// Session 是一个正在分享的会话
+type Session struct {
+	Code string
+	// Input 接收观看者发送的输入，只有在 Writable 时才会有输入
+	Input <-chan string
+
+	mu      sync.Mutex
+	last    Snapshot
+	viewers map[*Viewer]struct{}
+	input   chan string
+	done    chan struct{}
+}
+
+// Viewer 是观看分享会话的一方
+type Viewer struct {
+	// Updates 总是只保留最新的快照
+	Updates <-chan Snapshot
+
+	session *Session
+	updates chan Snapshot
+	done    chan struct{}
+}
+
+var (
+	mu       sync.Mutex
+	sessions = map[string]*Session{}
+)
+
+// Start 创建一个新的分享会话并分配分享码
+func Start() *Session {
+	mu.Lock()
+	defer mu.Unlock()
+
+	code := newCode()
+	for sessions[code] != nil {
+		code = newCode()
+	}
+	input := make(chan string, 16)
+	s := &Session{Code: code, Input: input, viewers: map[*Viewer]struct{}{}, input: input, done: make(chan struct{})}
+	sessions[code] = s
+	return s
+}
+
+// Lookup 根据分享码查找会话
+func Lookup(code string) (*Session, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	s, ok := sessions[code]
+	return s, ok
+}
+
+func newCode() string {
+	b := make([]byte, codeLength)
+	rand.Read(b)
+	for i := range b {
+		b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+	}
+	return string(b)
+}
+
+// Publish 把最新状态推送给所有观看者
+func (s *Session) Publish(snap Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap.Writable = s.last.Writable
+	s.last = snap
+	for v := range s.viewers {
+		v.push(snap)
+	}
+}
+
+// SetWritable 设置观看者是否可以输入
+func (s *Session) SetWritable(writable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last.Writable = writable
+	for v := range s.viewers {
+		v.push(s.last)
+	}
+}
+
+// Writable 返回观看者是否可以输入
+func (s *Session) Writable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last.Writable
+}
+
+// Viewers 返回当前观看者数量
+func (s *Session) Viewers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.viewers)
+}
+
+// Stop 结束分享，通知所有观看者
+func (s *Session) Stop() {
+	mu.Lock()
+	delete(sessions, s.Code)
+	mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last.Closed {
+		return
+	}
+	s.last.Closed = true
+	for v := range s.viewers {
+		v.push(s.last)
+	}
+	s.viewers = map[*Viewer]struct{}{}
+	close(s.done)
+}
+
+// Done 返回的通道在分享结束后关闭，等待 Input 的一方用它退出
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Watch 开始观看会话，立即收到当前状态
+func (s *Session) Watch() *Viewer {
+	updates := make(chan Snapshot, 1)
+	v := &Viewer{Updates: updates, session: s, updates: updates, done: make(chan struct{})}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.viewers[v] = struct{}{}
+	v.push(s.last)
+	return v
+}
+
+// Session 返回观看的会话
+func (v *Viewer) Session() *Session {
+	return v.session
+}
+
+// Send 以观看者身份输入，会话只读时返回 false
+func (v *Viewer) Send(input string) bool {
+	if !v.session.Writable() {
+		return false
+	}
+	select {
+	case v.session.input <- input:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close 停止观看
+func (v *Viewer) Close() {
+	s := v.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.viewers, v)
+	select {
+	case <-v.done:
+	default:
+		close(v.done)
+	}
+}
+
+// Done 返回的通道在停止观看后关闭，等待 Updates 的一方用它退出
+func (v *Viewer) Done() <-chan struct{} {
+	return v.done
+}
+
+// push 用最新快照替换尚未读取的旧快照，调用方需持有会话的锁
+func (v *Viewer) push(snap Snapshot) {
+	select {
+	case <-v.updates:
+	default:
+	}
+	v.updates <- snap
+}
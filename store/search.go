@@ -0,0 +1,241 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"sshtalk/conversation"
+)
+
+// 搜索结果摘要在匹配位置前后保留的字符数
+const snippetRadius = 40
+
+// Result 是一条搜索结果
+type Result struct {
+	ConversationID string    `json:"conversation_id"`
+	Title          string    `json:"title"`
+	MessageIndex   int       `json:"message_index"`
+	Role           string    `json:"role"`
+	Snippet        string    `json:"snippet"`
+	Time           time.Time `json:"time"`
+	Score          int       `json:"score"`
+}
+
+// index 是消息内容的倒排索引，按文件修改时间增量更新
+type index struct {
+	mu       sync.Mutex
+	docs     map[string]*indexedConv   // 对话 ID -> 已索引的对话
+	postings map[string]map[docKey]int // 词 -> 消息 -> 出现次数
+}
+
+type docKey struct {
+	conv string
+	msg  int
+}
+
+type indexedConv struct {
+	modTime time.Time
+	conv    conversation.Conversation
+	terms   map[string]struct{}
+}
+
+// tokenize 把文本切分为小写的词，汉字等没有空格分隔的文字逐字切分
+func tokenize(text string) []string {
+	var tokens []string
+	var cur []rune
+	flush := func() {
+		if len(cur) > 0 {
+			tokens = append(tokens, string(cur))
+			cur = cur[:0]
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r):
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			cur = append(cur, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+func (s *Store) searchIndex() *index {
+	s.indexOnce.Do(func() {
+		s.idx = &index{docs: map[string]*indexedConv{}, postings: map[string]map[docKey]int{}}
+	})
+	return s.idx
+}
+
+// refreshIndex 重新索引新增或修改过的对话文件，并移除已删除的对话
+func (s *Store) refreshIndex(idx *index) error {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "conversations"))
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !validID(id) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		seen[id] = true
+		if doc, ok := idx.docs[id]; ok && doc.modTime.Equal(info.ModTime()) {
+			continue
+		}
+		c, err := s.Get(id)
+		if err != nil {
+			continue
+		}
+		idx.remove(id)
+		idx.add(c, info.ModTime())
+	}
+
+	for id := range idx.docs {
+		if !seen[id] {
+			idx.remove(id)
+		}
+	}
+	return nil
+}
+
+func (idx *index) add(c conversation.Conversation, modTime time.Time) {
+	doc := &indexedConv{modTime: modTime, conv: c, terms: map[string]struct{}{}}
+	for i, m := range c.Messages {
+		for _, t := range tokenize(m.Content) {
+			p, ok := idx.postings[t]
+			if !ok {
+				p = map[docKey]int{}
+				idx.postings[t] = p
+			}
+			p[docKey{conv: c.ID, msg: i}]++
+			doc.terms[t] = struct{}{}
+		}
+	}
+	idx.docs[c.ID] = doc
+}
+
+func (idx *index) remove(id string) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for t := range doc.terms {
+		p := idx.postings[t]
+		for k := range p {
+			if k.conv == id {
+				delete(p, k)
+			}
+		}
+		if len(p) == 0 {
+			delete(idx.postings, t)
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// Search 在 owner 的对话中查找包含所有查询词的消息，按匹配次数和时间排序
+func (s *Store) Search(owner, query string, limit int) ([]Result, error) {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	idx := s.searchIndex()
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := s.refreshIndex(idx); err != nil {
+		return nil, err
+	}
+
+	// 从最短的倒排表开始求交集
+	sort.Slice(terms, func(i, j int) bool {
+		return len(idx.postings[terms[i]]) < len(idx.postings[terms[j]])
+	})
+	scores := map[docKey]int{}
+	for k, n := range idx.postings[terms[0]] {
+		if idx.docs[k.conv].conv.Owner == owner {
+			scores[k] = n
+		}
+	}
+	for _, t := range terms[1:] {
+		p := idx.postings[t]
+		for k := range scores {
+			n, ok := p[k]
+			if !ok {
+				delete(scores, k)
+				continue
+			}
+			scores[k] += n
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for k, score := range scores {
+		c := idx.docs[k.conv].conv
+		m := c.Messages[k.msg]
+		results = append(results, Result{
+			ConversationID: c.ID,
+			Title:          c.Title,
+			MessageIndex:   k.msg,
+			Role:           m.Role,
+			Snippet:        snippet(m.Content, terms),
+			Time:           m.Time,
+			Score:          score,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Time.After(results[j].Time)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// snippet 截取第一个匹配词附近的文本
+func snippet(content string, terms []string) string {
+	runes := []rune(content)
+	lower := strings.ToLower(content)
+	if len([]rune(lower)) != len(runes) {
+		runes = []rune(lower)
+	}
+	pos := -1
+	for _, t := range terms {
+		if i := strings.Index(lower, t); i >= 0 {
+			pos = len([]rune(lower[:i]))
+			break
+		}
+	}
+	if pos < 0 {
+		pos = 0
+	}
+
+	start := max(0, pos-snippetRadius)
+	end := min(len(runes), pos+snippetRadius)
+	text := strings.Join(strings.Fields(string(runes[start:end])), " ")
+	if start > 0 {
+		text = "…" + text
+	}
+	if end < len(runes) {
+		text += "…"
+	}
+	return text
+}
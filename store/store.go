@@ -0,0 +1,271 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sshtalk/conversation"
+)
+
+// ErrNotFound 表示对话不存在
+var ErrNotFound = errors.New("conversation not found")
+
+// ErrConflict 表示对话在读取之后被其他会话修改过
+var ErrConflict = errors.New("conversation was modified by another session")
+
+// Store 把对话以 JSON 文件的形式保存在数据目录中。
+// 使用普通文件而不是嵌入式数据库，SSH 服务、HTTP 服务和命令行可以同时读写同一个目录
+type Store struct {
+	dir string
+	// mu 串行化本进程内基于版本的读-改-写，见 Update 和 SaveMerged
+	mu sync.Mutex
+
+	indexOnce sync.Once
+	idx       *index
+}
+
+var (
+	defaultStore    *Store
+	defaultStoreErr error
+	defaultOnce     sync.Once
+)
+
+// Default 返回由 SSHTALK_DATA_DIR 指定的存储，默认为当前目录下的 .sshtalk
+func Default() (*Store, error) {
+	defaultOnce.Do(func() {
+		dir := os.Getenv("SSHTALK_DATA_DIR")
+		if dir == "" {
+			dir = ".sshtalk"
+		}
+		defaultStore, defaultStoreErr = Open(dir)
+	})
+	return defaultStore, defaultStoreErr
+}
+
+// Open 打开数据目录，不存在时创建
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "conversations"), 0o700); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir 返回数据目录
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// NewID 生成随机 ID
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, "conversations", id+".json")
+}
+
+// validID 防止 ID 中包含路径分隔符
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\.`)
+}
+
+// Save 保存对话并更新修改时间，ID 为空时分配新 ID
+func (s *Store) Save(c *conversation.Conversation) error {
+	c.Updated = time.Now()
+	return s.Put(c)
+}
+
+// Update 保存读取后修改的对话，base 是读取时的 Updated。
+// 对话在读取之后被其他会话修改过时不保存并返回 ErrConflict，对话已被删除时重新创建
+func (s *Store) Update(c *conversation.Conversation, base time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.current(c.ID, base); err != nil {
+		return err
+	}
+	return s.Save(c)
+}
+
+// SaveMerged 保存会话中持续修改的对话。base 是读取或上次保存对话时的 Updated，
+// c 的前 saved 条消息在那时已经保存。SSH 会话、WebSocket 会话和 /api/conversations 可能同时修改同一个对话，
+// 对话在 base 之后被其他会话修改过时，c 中新增的消息接在已保存的消息后面，其他字段以已保存的为准。
+// 返回 true 表示合并了其他会话的修改，此时 c 被替换为合并后的对话
+func (s *Store) SaveMerged(c *conversation.Conversation, base time.Time, saved int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, err := s.current(c.ID, base)
+	if !errors.Is(err, ErrConflict) {
+		if err != nil {
+			return false, err
+		}
+		return false, s.Save(c)
+	}
+	saved = min(max(saved, 0), len(c.Messages))
+	cur.Messages = append(cur.Messages, c.Messages[saved:]...)
+	if err := s.Save(&cur); err != nil {
+		return false, err
+	}
+	*c = cur
+	return true, nil
+}
+
+// current 读取保存的对话并检查版本，版本不是 base 时返回对话和 ErrConflict。
+// 新对话和已被删除的对话没有版本，返回 nil
+func (s *Store) current(id string, base time.Time) (conversation.Conversation, error) {
+	if id == "" {
+		return conversation.Conversation{}, nil
+	}
+	cur, err := s.Get(id)
+	if errors.Is(err, ErrNotFound) {
+		return cur, nil
+	}
+	if err != nil {
+		return cur, err
+	}
+	if !cur.Updated.Equal(base) {
+		return cur, ErrConflict
+	}
+	return cur, nil
+}
+
+// Put 原样保存对话，不修改更新时间，用于导入
+func (s *Store) Put(c *conversation.Conversation) error {
+	if c.ID == "" {
+		c.ID = NewID()
+	}
+	if !validID(c.ID) {
+		return fmt.Errorf("invalid conversation id %q", c.ID)
+	}
+	if c.Created.IsZero() {
+		c.Created = time.Now()
+	}
+	if c.Title == "" {
+		c.Title = c.DefaultTitle()
+	}
+	if c.Updated.IsZero() {
+		c.Updated = c.Created
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.path(c.ID), data, 0o600)
+}
+
+// Get 读取对话
+func (s *Store) Get(id string) (conversation.Conversation, error) {
+	var c conversation.Conversation
+	if !validID(id) {
+		return c, ErrNotFound
+	}
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return c, ErrNotFound
+	}
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// Find 按 ID 或 ID 前缀查找属于 owner 的对话
+func (s *Store) Find(owner, idPrefix string) (conversation.Conversation, error) {
+	if c, err := s.Get(idPrefix); err == nil && c.Owner == owner {
+		return c, nil
+	}
+	list, err := s.List(owner)
+	if err != nil {
+		return conversation.Conversation{}, err
+	}
+	for _, c := range list {
+		if strings.HasPrefix(c.ID, idPrefix) {
+			return s.Get(c.ID)
+		}
+	}
+	return conversation.Conversation{}, ErrNotFound
+}
+
+// List 返回 owner 的所有对话，按更新时间倒序
+func (s *Store) List(owner string) ([]conversation.Conversation, error) {
+	all, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+	var list []conversation.Conversation
+	for _, c := range all {
+		if c.Owner == owner {
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+// All 返回所有对话，按更新时间倒序
+func (s *Store) All() ([]conversation.Conversation, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "conversations"))
+	if err != nil {
+		return nil, err
+	}
+	var list []conversation.Conversation
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		c, err := s.Get(id)
+		if err != nil {
+			continue
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Updated.After(list[j].Updated)
+	})
+	return list, nil
+}
+
+// Delete 删除对话
+func (s *Store) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// WriteFileAtomic 先写临时文件再重命名，避免其他进程读到写了一半的文件
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
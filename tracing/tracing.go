@@ -0,0 +1,119 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"sshtalk/store"
+)
+
+// name 是所有 span 使用的 tracer 名称，也是默认的服务名
+const name = "sshtalk"
+
+// Tracer 返回全局的 tracer，没有配置导出器时 span 不会被记录
+func Tracer() trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// Setup 按 SSHTALK_TRACE_EXPORTER 配置链路追踪：
+//   - otlp：通过 OTLP/HTTP 导出，地址等由标准的 OTEL_EXPORTER_OTLP_* 变量配置
+//   - stdout：每个 span 结束时以 JSON 输出到标准输出
+//   - file：以 JSON 追加到 SSHTALK_TRACE_FILE，默认为数据目录下的 traces.jsonl
+//
+// 为空时不记录 span。返回的函数在退出前调用，用于导出剩余的 span
+func Setup(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	noop := func(context.Context) error { return nil }
+
+	exporter := strings.ToLower(os.Getenv("SSHTALK_TRACE_EXPORTER"))
+	var opt sdktrace.TracerProviderOption
+	var closer io.Closer
+	switch exporter {
+	case "", "none":
+		return noop, nil
+	case "otlp":
+		exp, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return noop, err
+		}
+		opt = sdktrace.WithBatcher(exp)
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return noop, err
+		}
+		// 本地调试时逐个输出，退出时不会丢失
+		opt = sdktrace.WithSyncer(exp)
+	case "file":
+		path, err := tracePath()
+		if err != nil {
+			return noop, err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return noop, err
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return noop, err
+		}
+		opt = sdktrace.WithSyncer(exp)
+		closer = f
+	default:
+		return noop, fmt.Errorf("unknown trace exporter %q, expected otlp, stdout or file", exporter)
+	}
+
+	// OTEL_SERVICE_NAME 和 OTEL_RESOURCE_ATTRIBUTES 可以覆盖默认的服务名
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName(name)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return noop, err
+	}
+
+	tp := sdktrace.NewTracerProvider(opt, sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	slog.Info("tracing enabled", "exporter", exporter)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+func tracePath() (string, error) {
+	if path := os.Getenv("SSHTALK_TRACE_FILE"); path != "" {
+		return path, nil
+	}
+	st, err := store.Default()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(st.Dir(), "traces.jsonl"), nil
+}
+
+// RecordError 把错误记录到 span 上并把状态设为失败
+func RecordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,63 @@
+package ui
+
+import (
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/openai/openai-go"
+
+	"sshtalk/provider"
+)
+
+// runCommand 处理私聊中的斜杠命令，ok 为 false 表示输入不是命令
+func (m *model) runCommand(input string) (cmd tea.Cmd, ok bool) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(input), " ")
+	arg = strings.TrimSpace(arg)
+
+	switch name {
+	case "/clear":
+		// 清空所有消息记录，只保留系统提示
+		m.rawMessages = []message{}
+		m.messages = []string{}
+		m.chatHistory = []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(provider.SystemPrompt),
+		}
+
+		// 重设视图，确保欢迎消息居中
+		m.showWelcome()
+		m.newConversation()
+		return nil, true
+	case "/join":
+		if arg == "" {
+			return nil, false
+		}
+		return m.joinRoom(arg), true
+	case "/share":
+		return m.startShare(arg), true
+	case "/unshare":
+		m.stopShare()
+		return nil, true
+	case "/history":
+		m.showHistory()
+		return nil, true
+	case "/open":
+		if arg == "" {
+			return nil, false
+		}
+		m.openConversation(arg)
+		return nil, true
+	case "/search":
+		if arg == "" {
+			return nil, false
+		}
+		m.search(arg)
+		return nil, true
+	case "/export":
+		m.export(arg)
+		return nil, true
+	case "/token":
+		m.tokenCommand(arg)
+		return nil, true
+	}
+	return nil, false
+}
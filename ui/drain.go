@@ -0,0 +1,95 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"sshtalk/drain"
+)
+
+// 服务器关闭时，空闲的会话显示提示这么久之后关闭
+const drainNotice = 10 * time.Second
+
+// errShutdown 是截止时间到达时被中断的回复在审计日志中的原因
+var errShutdown = fmt.Errorf("server shutting down: %w", context.Canceled)
+
+type (
+	drainMsg     struct{}
+	drainTickMsg struct{}
+)
+
+// drainState 记录服务器关闭的进度
+type drainState struct {
+	deadline  time.Time // 进行中的回复必须结束的时间
+	idleSince time.Time // 会话最近一次变为空闲的时间
+}
+
+// waitForDrain 等待服务器开始关闭，会话先结束时返回 nil
+func waitForDrain(ctx context.Context) tea.Cmd {
+	return func() tea.Msg {
+		select {
+		case <-drain.Started():
+			return drainMsg{}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func drainTick() tea.Cmd {
+	return tea.Tick(time.Second, func(time.Time) tea.Msg { return drainTickMsg{} })
+}
+
+// startDrain 显示关闭提示并开始倒计时，之后不再接受新消息
+func (m *model) startDrain() tea.Cmd {
+	m.drain = &drainState{deadline: drain.Deadline(), idleSince: time.Now()}
+	return m.drainTick()
+}
+
+// drainTick 更新倒计时。进行中的回复可以生成到截止时间，空闲的会话在提示显示一段时间后关闭
+func (m *model) drainTick() tea.Cmd {
+	now := time.Now()
+	if m.turn != nil {
+		if now.Before(m.drain.deadline) {
+			m.drain.idleSince = now
+			return drainTick()
+		}
+		m.interruptTurn(errShutdown)
+	}
+	if !now.Before(m.closeAt()) {
+		m.Close()
+		return tea.Quit
+	}
+	return drainTick()
+}
+
+// closeAt 返回会话将要关闭的时间
+func (m *model) closeAt() time.Time {
+	if m.turn != nil {
+		return m.drain.deadline
+	}
+	at := m.drain.idleSince.Add(drainNotice)
+	if at.After(m.drain.deadline) {
+		return m.drain.deadline
+	}
+	return at
+}
+
+// drainBanner 返回关闭倒计时的提示，服务器没有关闭时为空
+func (m *model) drainBanner() string {
+	if m.drain == nil {
+		return ""
+	}
+	secs := int(math.Ceil(time.Until(m.closeAt()).Seconds()))
+	if secs < 0 {
+		secs = 0
+	}
+	if m.turn != nil {
+		return fmt.Sprintf("Server is shutting down · finishing this reply, closing in %ds at most", secs)
+	}
+	return fmt.Sprintf("Server is shutting down · this session closes in %ds", secs)
+}
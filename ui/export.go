@@ -0,0 +1,75 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+
+	"sshtalk/conversation"
+	"sshtalk/room"
+)
+
+// conversation 把当前显示的消息转换为可导出的对话，不包含尚未完成的回复
+func (m *model) conversation() conversation.Conversation {
+	c := conversation.Conversation{
+		Model:   m.provider.Model,
+		Created: m.created,
+	}
+	for i, msg := range m.rawMessages {
+		if i == len(m.rawMessages)-1 && !msg.fromUser && (m.isWaiting || !m.lastMsgDone) {
+			break
+		}
+		if msg.blocked {
+			continue
+		}
+		cm := conversation.Message{
+			Role:             conversation.RoleAssistant,
+			Name:             msg.from,
+			Content:          msg.content,
+			Time:             msg.time,
+			PromptTokens:     msg.promptTokens,
+			CompletionTokens: msg.completionTokens,
+		}
+		switch {
+		case msg.fromUser:
+			cm.Role = conversation.RoleUser
+			cm.Name = ""
+		case msg.tool:
+			cm.Role = conversation.RoleTool
+		case msg.from != "" && msg.from != room.AIName:
+			// 聊天室中其他人的消息
+			cm.Role = conversation.RoleUser
+		default:
+			cm.Model = m.provider.Model
+		}
+		c.Messages = append(c.Messages, cm)
+	}
+	if member := m.room.get(); member != nil {
+		c.Title = "#" + member.Room().Name
+	} else {
+		c.Title = c.DefaultTitle()
+	}
+	return c
+}
+
+// export 导出当前对话，format 为 md、json 或 html
+func (m *model) export(format string) {
+	c := m.conversation()
+	data, err := conversation.Export(c, format)
+	if err != nil {
+		m.notice = err.Error()
+		return
+	}
+	name := conversation.FileName(c, format)
+
+	notice := fmt.Sprintf("Exported to %s", name)
+	if m.exportFn != nil {
+		notice, err = m.exportFn(name, data)
+	} else {
+		err = os.WriteFile(name, data, 0o644)
+	}
+	if err != nil {
+		m.notice = fmt.Sprintf("Export failed: %v", err)
+		return
+	}
+	m.notice = notice
+}
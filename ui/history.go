@@ -0,0 +1,166 @@
+package ui
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/openai/openai-go"
+
+	"sshtalk/conversation"
+	"sshtalk/provider"
+	"sshtalk/store"
+)
+
+// /history 最多列出的对话数
+const historyListSize = 20
+
+// saveConversation 保存当前私聊。没有身份（例如没有公钥的 SSH 用户）时不保存
+func (m *model) saveConversation() {
+	if m.identity == "" || m.room.get() != nil || m.share.viewer() != nil {
+		return
+	}
+	st, err := store.Default()
+	if err != nil {
+		slog.ErrorContext(m.ctx, "failed to open store", "err", err)
+		return
+	}
+	c := m.conversation()
+	if len(c.Messages) == 0 {
+		return
+	}
+	c.ID = m.convID
+	c.Owner = m.identity
+	if m.convTitle != "" {
+		c.Title = m.convTitle
+	}
+	merged, err := st.SaveMerged(&c, m.convUpdated, m.convSaved)
+	if err != nil {
+		slog.ErrorContext(m.ctx, "failed to save conversation", "err", err)
+		return
+	}
+	if merged {
+		// 其他会话在此期间修改了对话，显示合并后的对话
+		m.loadConversation(c)
+		m.notice = "Merged changes made to this conversation elsewhere"
+		return
+	}
+	m.convID = c.ID
+	m.convTitle = c.Title
+	m.convUpdated = c.Updated
+	m.convSaved = len(c.Messages)
+}
+
+// showHistory 在视口中列出最近的对话，发送下一条消息或重新渲染后恢复
+func (m *model) showHistory() {
+	if m.identity == "" {
+		m.notice = "History is only kept for SSH users who log in with a public key"
+		return
+	}
+	st, err := store.Default()
+	if err != nil {
+		m.notice = err.Error()
+		return
+	}
+	list, err := st.List(m.identity)
+	if err != nil {
+		m.notice = err.Error()
+		return
+	}
+	if len(list) == 0 {
+		m.notice = "No saved conversations yet"
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("Recent conversations (/open <id> to continue):\n\n")
+	for i, c := range list {
+		if i == historyListSize {
+			break
+		}
+		fmt.Fprintf(&b, "%s  %s  %s\n", shortID(c.ID), c.Updated.Format("2006-01-02 15:04"), c.Title)
+	}
+	m.viewport.SetContent(m.botMsgStyle.Width(m.viewport.Width).Render(b.String()))
+	m.viewport.GotoTop()
+}
+
+// openConversation 载入保存的对话并继续
+func (m *model) openConversation(id string) {
+	if m.identity == "" {
+		m.notice = "History is only kept for SSH users who log in with a public key"
+		return
+	}
+	st, err := store.Default()
+	if err != nil {
+		m.notice = err.Error()
+		return
+	}
+	c, err := st.Find(m.identity, id)
+	if err != nil {
+		m.notice = fmt.Sprintf("Can't open %s: %v", id, err)
+		return
+	}
+	m.loadConversation(c)
+}
+
+// loadConversation 用保存的对话替换当前消息和聊天历史
+func (m *model) loadConversation(c conversation.Conversation) {
+	m.convID = c.ID
+	m.convTitle = c.Title
+	m.convUpdated = c.Updated
+	m.convSaved = len(c.Messages)
+	m.created = c.Created
+	m.rawMessages = []message{}
+	m.chatHistory = []openai.ChatCompletionMessageParamUnion{
+		openai.SystemMessage(provider.SystemPrompt),
+	}
+
+	for _, cm := range c.Messages {
+		msg := message{
+			content:          cm.Content,
+			time:             cm.Time,
+			promptTokens:     cm.PromptTokens,
+			completionTokens: cm.CompletionTokens,
+		}
+		switch cm.Role {
+		case conversation.RoleUser:
+			msg.fromUser = true
+			m.chatHistory = append(m.chatHistory, openai.UserMessage(cm.Content))
+		case conversation.RoleAssistant:
+			m.chatHistory = append(m.chatHistory, openai.AssistantMessage(cm.Content))
+		case conversation.RoleTool:
+			// 工具调用只用于显示，原始的调用 ID 没有保存，不能放回历史
+			msg.tool = true
+		}
+		m.rawMessages = append(m.rawMessages, msg)
+	}
+
+	m.notice = fmt.Sprintf("Opened %s", c.Title)
+	m.searchResults = nil
+	if len(m.rawMessages) == 0 {
+		m.messages = []string{}
+		m.showWelcome()
+		return
+	}
+	m.needsReformat = true
+	m.formatMessages()
+	m.viewport.GotoBottom()
+}
+
+// newConversation 开始新的对话，之前的对话已经保存
+func (m *model) newConversation() {
+	m.convID = ""
+	m.convTitle = ""
+	m.convUpdated = time.Time{}
+	m.convSaved = 0
+	m.created = time.Now()
+}
+
+// shortID 返回用于显示的短 ID，/open 接受 ID 前缀
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
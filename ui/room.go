@@ -0,0 +1,257 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/openai/openai-go"
+
+	"sshtalk/audit"
+	"sshtalk/moderation"
+	"sshtalk/provider"
+	"sshtalk/redact"
+	"sshtalk/room"
+)
+
+// 聊天室中 AI 使用的系统提示
+const roomSystemPrompt = `You are "ai", a participant in a group chat. Each user message is prefixed with the sender's name. Only answer what you were asked. Do not use markdown except when user asks for it.`
+
+// 聊天室事件，member 用于丢弃已离开的聊天室的事件
+type roomEventMsg struct {
+	member *room.Member
+	event  room.Event
+}
+
+// roomSession 保存当前加入的聊天室。SSH 会话断开时 Close 会在其他 goroutine 中调用，因此需要加锁
+type roomSession struct {
+	mu     sync.Mutex
+	member *room.Member
+}
+
+func (s *roomSession) get() *room.Member {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.member
+}
+
+// swap 替换当前聊天室，并离开之前的聊天室
+func (s *roomSession) swap(member *room.Member) *room.Member {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.member
+	if prev != nil {
+		prev.Leave()
+	}
+	s.member = member
+	return prev
+}
+
+var responderOnce sync.Once
+
+// roomResponder 使用 OpenAI 为聊天室生成回复
+func roomResponder(ctx context.Context, history []room.Message, update func(string)) (content string, err error) {
+	redactor, err := redact.Default()
+	if err != nil {
+		return "", err
+	}
+
+	// 历史中的人类消息每次都会发往模型，逐条检查敏感内容
+	messages := []openai.ChatCompletionMessageParamUnion{openai.SystemMessage(roomSystemPrompt)}
+	var asker room.Message
+	var unchecked []string // 上一条 AI 回复之后的人类消息，还没有经过审核钩子
+	for _, msg := range history {
+		if msg.AI {
+			messages = append(messages, openai.AssistantMessage(msg.Content))
+			unchecked = nil
+			continue
+		}
+		content, _, err := redactor.Check(msg.Content)
+		if err != nil {
+			var blocked *redact.BlockedError
+			if errors.As(err, &blocked) {
+				actorCtx := audit.WithActor(ctx, audit.Actor{Source: "room", User: msg.From})
+				audit.RecordBlocked(actorCtx, provider.Default().Model, "", err)
+			}
+			return "", err
+		}
+		messages = append(messages, openai.UserMessage(fmt.Sprintf("%s: %s", msg.From, content)))
+		asker = msg
+		asker.Content = content
+		unchecked = append(unchecked, content)
+	}
+
+	// 聊天室的回复由最后一条人类消息触发，审计日志只知道发送者在聊天室中的名字
+	ctx = audit.WithActor(ctx, audit.Actor{Source: "room", User: asker.From})
+	llm := provider.Default()
+	start := time.Now()
+	defer func() {
+		e := audit.Entry{
+			Model:      llm.Model,
+			Prompt:     asker.Content,
+			Response:   content,
+			Outcome:    audit.Outcome(err),
+			DurationMS: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		audit.Record(ctx, e)
+	}()
+
+	moderator, err := moderation.Default()
+	if err != nil {
+		return "", err
+	}
+	for _, text := range unchecked {
+		if _, err := moderator.Check(ctx, moderation.StageInput, text); err != nil {
+			return "", err
+		}
+	}
+
+	stream := llm.NewStreaming(ctx, openai.ChatCompletionNewParams{
+		Messages: messages,
+	})
+	acc := openai.ChatCompletionAccumulator{}
+	for stream.Next() {
+		acc.AddChunk(stream.Current())
+		if len(acc.Choices) > 0 {
+			update(acc.Choices[0].Message.Content)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return "", err
+	}
+	if len(acc.Choices) == 0 {
+		return "", nil
+	}
+	return acc.Choices[0].Message.Content, nil
+}
+
+// waitForRoomEvent 等待下一个聊天室事件，成员离开后返回 nil
+func waitForRoomEvent(member *room.Member) tea.Cmd {
+	return func() tea.Msg {
+		e, ok := member.Next()
+		if !ok {
+			return nil
+		}
+		return roomEventMsg{member: member, event: e}
+	}
+}
+
+// joinRoom 离开当前聊天室（如果有）并加入新的聊天室
+func (m *model) joinRoom(name string) tea.Cmd {
+	if name == "" {
+		return nil
+	}
+	responderOnce.Do(func() {
+		room.Default().SetResponder(roomResponder)
+	})
+
+	user := m.user
+	if user == "" {
+		user = "anonymous"
+	}
+	member := room.Default().Join(name, user)
+	if m.room.swap(member) == nil {
+		m.savedMessages = m.rawMessages
+	}
+	m.roomMembers = nil
+	m.rawMessages = []message{}
+	m.messages = []string{}
+	m.textarea.Placeholder = fmt.Sprintf("Message #%s, mention %s to ask the model...", name, room.Mention)
+	m.showWelcome()
+	return waitForRoomEvent(member)
+}
+
+// leaveRoom 离开聊天室并恢复私聊消息
+func (m *model) leaveRoom() {
+	if m.room.swap(nil) == nil {
+		return
+	}
+	m.roomMembers = nil
+	m.rawMessages = m.savedMessages
+	m.savedMessages = nil
+	m.textarea.Placeholder = "Send a message..."
+	if len(m.rawMessages) == 0 {
+		m.messages = []string{}
+		m.showWelcome()
+		return
+	}
+	m.needsReformat = true
+	m.formatMessages()
+	m.viewport.GotoBottom()
+}
+
+// handleRoomInput 处理聊天室中的输入
+func (m *model) handleRoomInput(input string) tea.Cmd {
+	switch {
+	case input == "/leave":
+		m.leaveRoom()
+		return nil
+	case strings.HasPrefix(input, "/join "):
+		return m.joinRoom(strings.TrimSpace(strings.TrimPrefix(input, "/join ")))
+	case input == "/export" || strings.HasPrefix(input, "/export "):
+		m.export(strings.TrimSpace(strings.TrimPrefix(input, "/export")))
+		return nil
+	}
+	if member := m.room.get(); member != nil {
+		member.Send(input)
+	}
+	return nil
+}
+
+// handleRoomEvent 把聊天室事件合并到消息列表
+func (m *model) handleRoomEvent(e roomEventMsg) tea.Cmd {
+	member := m.room.get()
+	// 事件可能来自已经离开的聊天室
+	if member == nil || e.member != member {
+		return nil
+	}
+	next := waitForRoomEvent(member)
+
+	if e.event.Members != nil {
+		m.roomMembers = e.event.Members
+		return next
+	}
+
+	msg := message{
+		content:  e.event.Message.Content,
+		fromUser: !e.event.Message.AI && e.event.Message.From == member.Name,
+		roomID:   e.event.Message.ID,
+		time:     e.event.Message.Time,
+	}
+	if !msg.fromUser {
+		msg.from = e.event.Message.From
+	}
+
+	updated := false
+	for i := len(m.rawMessages) - 1; i >= 0; i-- {
+		if m.rawMessages[i].roomID == msg.roomID {
+			m.rawMessages[i] = msg
+			updated = true
+			break
+		}
+	}
+	if !updated {
+		m.rawMessages = append(m.rawMessages, msg)
+	}
+
+	m.needsReformat = true
+	m.formatMessages()
+	m.viewport.GotoBottom()
+	return next
+}
+
+// roomStatus 返回聊天室名和在线成员，不在聊天室时为空
+func (m *model) roomStatus() string {
+	member := m.room.get()
+	if member == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%s · %s", member.Room().Name, strings.Join(m.roomMembers, ", "))
+}
@@ -0,0 +1,118 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+
+	"sshtalk/store"
+)
+
+// /search 最多显示的结果数
+const searchResultSize = 20
+
+// search 搜索保存的对话并在视口中列出结果
+func (m *model) search(query string) {
+	if m.identity == "" {
+		m.notice = "History is only kept for SSH users who log in with a public key"
+		return
+	}
+	st, err := store.Default()
+	if err != nil {
+		m.notice = err.Error()
+		return
+	}
+	results, err := st.Search(m.identity, query, searchResultSize)
+	if err != nil {
+		m.notice = err.Error()
+		return
+	}
+	if len(results) == 0 {
+		m.notice = fmt.Sprintf("No results for %q", query)
+		return
+	}
+	m.searchResults = results
+	m.searchSel = 0
+	m.notice = "↑/↓ to select, Enter to open, Esc to close"
+	m.renderSearchResults()
+}
+
+// renderSearchResults 在视口中显示搜索结果，选中的结果高亮
+func (m *model) renderSearchResults() {
+	var lines []string
+	for i, r := range m.searchResults {
+		line := fmt.Sprintf("%s  %s\n  %s: %s", r.Time.Format("2006-01-02"), r.Title, r.Role, r.Snippet)
+		style := m.botMsgStyle.Width(m.viewport.Width)
+		if i == m.searchSel {
+			style = style.Reverse(true)
+		}
+		lines = append(lines, style.Render(line))
+	}
+	m.viewport.SetContent(strings.Join(lines, "\n\n"))
+
+	// 保证选中的结果可见
+	offset := 0
+	for i := 0; i < m.searchSel; i++ {
+		offset += lipgloss.Height(lines[i]) + 1
+	}
+	if offset < m.viewport.YOffset || offset >= m.viewport.YOffset+m.viewport.Height-2 {
+		m.viewport.SetYOffset(offset)
+	}
+}
+
+// closeSearch 关闭搜索结果，恢复当前对话
+func (m *model) closeSearch() {
+	m.searchResults = nil
+	m.notice = ""
+	if len(m.rawMessages) == 0 {
+		m.showWelcome()
+		return
+	}
+	m.needsReformat = true
+	m.formatMessages()
+	m.viewport.GotoBottom()
+}
+
+// handleSearchKey 处理搜索结果列表中的按键，返回 false 表示按键不属于列表
+func (m *model) handleSearchKey(key tea.KeyMsg) bool {
+	switch key.Type {
+	case tea.KeyUp:
+		if m.searchSel > 0 {
+			m.searchSel--
+			m.renderSearchResults()
+		}
+	case tea.KeyDown:
+		if m.searchSel < len(m.searchResults)-1 {
+			m.searchSel++
+			m.renderSearchResults()
+		}
+	case tea.KeyEsc:
+		m.closeSearch()
+	case tea.KeyEnter:
+		if m.textarea.Value() != "" {
+			m.searchResults = nil
+			return false
+		}
+		r := m.searchResults[m.searchSel]
+		m.searchResults = nil
+		m.openConversation(r.ConversationID)
+		m.scrollToMessage(r.MessageIndex)
+	default:
+		return false
+	}
+	return true
+}
+
+// scrollToMessage 把视口滚动到第 i 条消息
+func (m *model) scrollToMessage(i int) {
+	if i < 0 || i >= len(m.messageStart) {
+		return
+	}
+	offset := 0
+	for _, entry := range m.messages[:m.messageStart[i]] {
+		offset += lipgloss.Height(entry)
+	}
+	m.viewport.SetYOffset(offset)
+}
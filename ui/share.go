@@ -0,0 +1,215 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"sshtalk/share"
+)
+
+type (
+	// 观看者输入的消息
+	shareInputMsg struct {
+		session *share.Session
+		input   string
+	}
+	// 被观看会话的最新状态
+	shareUpdateMsg struct {
+		viewer   *share.Viewer
+		snapshot share.Snapshot
+	}
+)
+
+// shareState 保存当前的分享或观看状态，会话断开时 Close 会在其他 goroutine 中调用
+type shareState struct {
+	mu      sync.Mutex
+	host    *share.Session // 正在分享的会话
+	watcher *share.Viewer  // 正在观看的会话
+}
+
+func (s *shareState) session() *share.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.host
+}
+
+func (s *shareState) viewer() *share.Viewer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watcher
+}
+
+// close 结束分享和观看
+func (s *shareState) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.host != nil {
+		s.host.Stop()
+		s.host = nil
+	}
+	if s.watcher != nil {
+		s.watcher.Close()
+		s.watcher = nil
+	}
+}
+
+// waitForShareInput 等待观看者的输入，分享结束后返回 nil
+func waitForShareInput(s *share.Session) tea.Cmd {
+	return func() tea.Msg {
+		select {
+		case input := <-s.Input:
+			return shareInputMsg{session: s, input: input}
+		case <-s.Done():
+			return nil
+		}
+	}
+}
+
+// waitForShareUpdate 等待被观看会话的下一次更新，停止观看后返回 nil
+func waitForShareUpdate(v *share.Viewer) tea.Cmd {
+	return func() tea.Msg {
+		select {
+		case snap := <-v.Updates:
+			return shareUpdateMsg{viewer: v, snapshot: snap}
+		case <-v.Done():
+			return nil
+		}
+	}
+}
+
+// startShare 开始分享当前会话，arg 为 rw 时允许观看者输入，ro 时收回输入权限
+func (m *model) startShare(arg string) tea.Cmd {
+	s := m.share.session()
+	var cmd tea.Cmd
+	if s == nil {
+		s = share.Start()
+		m.share.mu.Lock()
+		m.share.host = s
+		m.share.mu.Unlock()
+		cmd = waitForShareInput(s)
+	}
+
+	switch arg {
+	case "rw":
+		s.SetWritable(true)
+	case "ro", "":
+		s.SetWritable(false)
+	}
+	m.publish()
+	return cmd
+}
+
+// stopShare 结束分享
+func (m *model) stopShare() {
+	m.share.mu.Lock()
+	defer m.share.mu.Unlock()
+	if m.share.host != nil {
+		m.share.host.Stop()
+		m.share.host = nil
+	}
+}
+
+// watch 开始观看分享码对应的会话
+func (m *model) watch(code string) tea.Cmd {
+	s, ok := share.Lookup(strings.ToUpper(code))
+	if !ok {
+		m.shareNotice = fmt.Sprintf("No shared session with code %s", code)
+		return nil
+	}
+	v := s.Watch()
+	m.share.mu.Lock()
+	m.share.watcher = v
+	m.share.mu.Unlock()
+	return waitForShareUpdate(v)
+}
+
+// publish 把当前会话状态推送给观看者
+func (m *model) publish() {
+	s := m.share.session()
+	if s == nil {
+		return
+	}
+	msgs := make([]share.Message, len(m.rawMessages))
+	for i, msg := range m.rawMessages {
+		msgs[i] = share.Message{Content: msg.content, FromUser: msg.fromUser, From: msg.from}
+	}
+	s.Publish(share.Snapshot{Messages: msgs, Waiting: m.isWaiting, Done: m.lastMsgDone})
+}
+
+// handleShareInput 把观看者的输入当作本地输入发送
+func (m *model) handleShareInput(msg shareInputMsg) tea.Cmd {
+	if msg.session != m.share.session() {
+		return nil
+	}
+	next := waitForShareInput(msg.session)
+	if m.isWaiting || len(m.pendingTools) > 0 || m.room.get() != nil {
+		return next
+	}
+	return tea.Batch(next, m.sendUserMessage(msg.input))
+}
+
+// handleShareUpdate 用被观看会话的状态替换本地消息
+func (m *model) handleShareUpdate(msg shareUpdateMsg) tea.Cmd {
+	if msg.viewer != m.share.viewer() {
+		return nil
+	}
+	snap := msg.snapshot
+	m.shareWritable = snap.Writable
+	if snap.Closed {
+		m.shareNotice = "The shared session has ended"
+		return nil
+	}
+
+	m.rawMessages = make([]message, len(snap.Messages))
+	for i, sm := range snap.Messages {
+		m.rawMessages[i] = message{content: sm.Content, fromUser: sm.FromUser, from: sm.From}
+	}
+	m.isWaiting = snap.Waiting
+	m.lastMsgDone = snap.Done
+
+	if len(m.rawMessages) == 0 {
+		m.messages = []string{}
+		m.showWelcome()
+	} else {
+		m.needsReformat = true
+		m.formatMessages()
+		m.viewport.GotoBottom()
+	}
+	return waitForShareUpdate(msg.viewer)
+}
+
+// handleViewerInput 观看者按下回车时，在有权限时把输入转发给分享者
+func (m *model) handleViewerInput(input string) tea.Cmd {
+	if m.share.viewer().Send(input) {
+		m.textarea.Reset()
+		m.shareNotice = ""
+	} else {
+		m.shareNotice = "This session is read-only"
+	}
+	return nil
+}
+
+// shareStatus 返回分享相关的状态文字
+func (m *model) shareStatus() string {
+	if m.shareNotice != "" {
+		return m.shareNotice
+	}
+	if v := m.share.viewer(); v != nil {
+		mode := "read-only"
+		if m.shareWritable {
+			mode = "you can type"
+		}
+		return fmt.Sprintf("Watching %s · %s", v.Session().Code, mode)
+	}
+	if s := m.share.session(); s != nil {
+		mode := "read-only"
+		if s.Writable() {
+			mode = "viewers can type"
+		}
+		return fmt.Sprintf("Sharing %s · %d watching · %s", s.Code, s.Viewers(), mode)
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// 会话因超时关闭前最多提前这么久显示提示
+const timeoutWarning = time.Minute
+
+// 没有配置 SSHTALK_IDLE_TIMEOUT 时，会话没有输入这么久后关闭
+const defaultIdleTimeout = 30 * time.Minute
+
+// 会话超时关闭时被中断的回复在审计日志中的原因
+var (
+	errSessionLimit = fmt.Errorf("session time limit reached: %w", context.Canceled)
+	errSessionIdle  = fmt.Errorf("session idle timeout: %w", context.Canceled)
+)
+
+type timeoutTickMsg struct{}
+
+// Timeouts 读取 SSHTALK_IDLE_TIMEOUT 和 SSHTALK_MAX_SESSION 配置的空闲超时和最长时间，为 0 时不限制。
+// SSH 会话和网页终端使用相同的配置
+func Timeouts() (idle, maxDuration time.Duration, err error) {
+	if idle, err = durationEnv("SSHTALK_IDLE_TIMEOUT", defaultIdleTimeout); err != nil {
+		return 0, 0, err
+	}
+	if maxDuration, err = durationEnv("SSHTALK_MAX_SESSION", 0); err != nil {
+		return 0, 0, err
+	}
+	return idle, maxDuration, nil
+}
+
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
+// sessionTimer 记录会话的空闲时间和总时长
+type sessionTimer struct {
+	idle      time.Duration // 没有输入多久后关闭，0 表示不限制
+	max       time.Duration // 会话最长持续时间，0 表示不限制
+	start     time.Time
+	lastInput time.Time
+}
+
+// timeoutDeadline 返回会话因超时关闭的时间和原因，没有限制时返回零值。
+// 回复生成和工具执行期间不算空闲，等待用户确认工具调用时算空闲
+func (m *model) timeoutDeadline() (time.Time, string) {
+	t := m.timer
+	var at time.Time
+	reason := ""
+	if t.idle > 0 && !m.isWaiting {
+		at, reason = t.lastInput.Add(t.idle), "idle"
+	}
+	if t.max > 0 {
+		if end := t.start.Add(t.max); at.IsZero() || end.Before(at) {
+			at, reason = end, "max_duration"
+		}
+	}
+	return at, reason
+}
+
+// warnAt 返回开始显示超时提示的时间，提示时间不超过限制的一半
+func (m *model) warnAt(at time.Time, reason string) time.Time {
+	limit := m.timer.max
+	if reason == "idle" {
+		limit = m.timer.idle
+	}
+	return at.Add(-min(timeoutWarning, limit/2))
+}
+
+// touch 记录一次用户输入或一轮回复结束，重新开始计算空闲时间
+func (m *model) touch() {
+	m.timer.lastInput = time.Now()
+}
+
+// timeoutTick 检查会话是否超时。提示期间每秒更新倒计时，之前只在提示开始时检查一次
+func (m *model) timeoutTick() tea.Cmd {
+	at, reason := m.timeoutDeadline()
+	now := time.Now()
+	if at.IsZero() {
+		// 只有空闲限制且正在生成回复，回复结束时重新计时
+		return tea.Tick(time.Second, func(time.Time) tea.Msg { return timeoutTickMsg{} })
+	}
+	if !now.Before(at) {
+		return m.expire(reason)
+	}
+	wait := time.Second
+	if warn := m.warnAt(at, reason); now.Before(warn) {
+		wait = warn.Sub(now)
+	}
+	if m.timer.idle > 0 && m.isWaiting {
+		// 回复生成期间不计空闲时间，结束或开始等待确认后需要尽快检查
+		wait = min(wait, time.Second)
+	}
+	return tea.Tick(wait, func(time.Time) tea.Msg { return timeoutTickMsg{} })
+}
+
+// expire 在超时时保存对话并关闭会话
+func (m *model) expire(reason string) tea.Cmd {
+	slog.InfoContext(m.ctx, "closing session on timeout", "reason", reason, "duration_ms", time.Since(m.timer.start).Milliseconds())
+	if m.turn != nil {
+		err := errSessionLimit
+		if reason == "idle" {
+			err = errSessionIdle
+		}
+		m.interruptTurn(err)
+	} else {
+		m.saveConversation()
+	}
+	m.Close()
+	return tea.Quit
+}
+
+// timeoutBanner 返回超时前的倒计时提示，还没到提示时间时为空
+func (m *model) timeoutBanner() string {
+	at, reason := m.timeoutDeadline()
+	if at.IsZero() || time.Now().Before(m.warnAt(at, reason)) {
+		return ""
+	}
+	secs := max(int(math.Ceil(time.Until(at).Seconds())), 0)
+	if reason == "idle" {
+		return fmt.Sprintf("No activity · this session closes in %ds, press any key to stay", secs)
+	}
+	if m.identity == "" || m.room.get() != nil || m.share.viewer() != nil {
+		return fmt.Sprintf("Session time limit · closes in %ds, use /export to keep a copy", secs)
+	}
+	return fmt.Sprintf("Session time limit · closes in %ds, this conversation will be saved", secs)
+}
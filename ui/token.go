@@ -0,0 +1,96 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"sshtalk/auth"
+)
+
+// 在 TUI 中创建的令牌有效期
+const tokenTTL = 90 * 24 * time.Hour
+
+// tokenCommand 处理 /token [name]、/token list 和 /token revoke <id|name>。
+// 令牌绑定当前会话的身份，通过 HTTP 接口访问的是同一份对话。
+// 网页终端本身用令牌登录，不能用它创建或撤销令牌
+func (m *model) tokenCommand(arg string) {
+	if !m.allowTokens {
+		m.notice = "API tokens can only be managed over SSH"
+		return
+	}
+	if m.identity == "" {
+		m.notice = "API tokens are only available to SSH users who log in with a public key"
+		return
+	}
+	tokens, err := auth.Default()
+	if err != nil {
+		m.notice = err.Error()
+		return
+	}
+
+	sub, rest, _ := strings.Cut(arg, " ")
+	rest = strings.TrimSpace(rest)
+	switch sub {
+	case "list":
+		m.listTokens(tokens)
+	case "revoke":
+		if rest == "" {
+			m.notice = "Usage: /token revoke <id|name>"
+			return
+		}
+		t, err := tokens.RevokeOwned(m.identity, auth.ScopeChat, rest)
+		if err != nil {
+			m.notice = fmt.Sprintf("Can't revoke %s: %v", rest, err)
+			return
+		}
+		m.notice = fmt.Sprintf("Revoked token %s (%s)", t.ID, t.Name)
+	default:
+		name := arg
+		if name == "" {
+			name = "ssh-" + time.Now().Format("20060102-150405")
+		}
+		t, plain, err := tokens.Create(name, auth.ScopeChat, m.identity, tokenTTL)
+		if err != nil {
+			m.notice = err.Error()
+			return
+		}
+		// 明文令牌只显示在本地视口中，不发布给共享会话的观众
+		var b strings.Builder
+		fmt.Fprintf(&b, "Created API token %s (%s), valid until %s.\n", t.ID, t.Name, t.Expires.Format("2006-01-02"))
+		b.WriteString("It is shown only once, copy it now:\n\n")
+		b.WriteString(plain + "\n\n")
+		b.WriteString("Use it as a bearer token for the HTTP API, or type /token <token> in the web chat, to reach the same conversations as this SSH key.\n")
+		b.WriteString("/token list shows your tokens, /token revoke <id> revokes one.")
+		m.viewport.SetContent(m.botMsgStyle.Width(m.viewport.Width).Render(b.String()))
+		m.viewport.GotoTop()
+	}
+}
+
+// listTokens 在视口中列出当前身份的令牌
+func (m *model) listTokens(tokens *auth.Store) {
+	list, err := tokens.ListOwned(m.identity)
+	if err != nil {
+		m.notice = err.Error()
+		return
+	}
+	if len(list) == 0 {
+		m.notice = "No API tokens yet, /token creates one"
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("Your API tokens (/token revoke <id> to revoke):\n\n")
+	for _, t := range list {
+		expires := "never"
+		if !t.Expires.IsZero() {
+			expires = t.Expires.Format("2006-01-02")
+			if t.Expired() {
+				expires += " (expired)"
+			}
+		}
+		fmt.Fprintf(&b, "%s  %-9s  expires %s  %s\n", t.ID, t.Scope, expires, t.Name)
+	}
+	m.viewport.SetContent(m.botMsgStyle.Width(m.viewport.Width).Render(b.String()))
+	m.viewport.GotoTop()
+}
@@ -2,10 +2,12 @@ package ui
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/textarea"
@@ -13,34 +15,51 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
-	"github.com/openai/openai-go/packages/ssestream"
+
+	"sshtalk/audit"
+	"sshtalk/mcp"
+	"sshtalk/moderation"
+	"sshtalk/motd"
+	"sshtalk/provider"
+	"sshtalk/redact"
+	"sshtalk/store"
 )
 
 // 常量定义
 const (
 	thinkingText = "Thinking"
 	gap          = "\n\n"
-	systemPrompt = `Do not use markdown except when user asks for it.`
-	welcomeMsg   = `Welcome to sshtalk!
-	Type a message and press Enter to send.`
+	// 一轮对话中最多请求模型的次数，与 HTTP 接口相同，避免模型反复调用工具
+	maxToolRounds = 8
 )
 
-// 环境变量
-var (
-	openaiBaseURL = os.Getenv("OPENAI_BASE_URL")
-	openaiAPIKey  = os.Getenv("OPENAI_API_KEY")
-	openaiModel   = os.Getenv("OPENAI_MODEL")
-)
+// Options 是创建 UI 模型时的会话参数
+type Options struct {
+	// Context 是会话的 context，携带日志字段，会话结束时取消进行中的请求，为空时使用 context.Background()
+	Context context.Context
+	// Identity 标识对话的所有者，用于保存和载入历史，为空时不保存
+	Identity string
+	User     string // 显示在聊天室中的用户名
+	// AllowTokens 允许用 /token 管理 Identity 的 API 令牌，只在登录方式比令牌更可信的 SSH 和本地会话中开启
+	AllowTokens bool
+	Room        string // 启动后直接加入的聊天室，为空则进入私聊
+	Watch       string // 启动后观看的分享码
+	// Export 接收 /export 生成的文件并返回给用户的提示，为空时写入当前目录
+	Export func(name string, data []byte) (string, error)
+	// IdleTimeout 是没有输入多久后关闭会话，MaxDuration 是会话的最长时间，为 0 时不限制
+	IdleTimeout time.Duration
+	MaxDuration time.Duration
+}
 
 // StartLocalUI 启动本地 TUI 模式
 func StartLocalUI() {
-	m := NewModel()
+	m := NewModel(Options{Identity: "local", User: os.Getenv("USER"), AllowTokens: true})
 	p := tea.NewProgram(&m, tea.WithAltScreen())
 	m.program = p
 	if _, err := p.Run(); err != nil {
 		log.Fatal(err)
 	}
+	m.Close()
 }
 
 type (
@@ -50,19 +69,56 @@ type (
 		content      string
 		done         bool
 		err          error
-		nextChunkCmd tea.Cmd // 获取下一个块的命令
+		nextChunkCmd tea.Cmd                                // 获取下一个块的命令
+		stream       *provider.Stream                       // 响应所属的流
+		toolCalls    []openai.ChatCompletionMessageToolCall // 模型请求的工具调用（仅在 done 时）
+		usage        openai.CompletionUsage                 // token 用量（仅在 done 时）
+		notes        []string                               // 审核钩子的提示（仅在 done 时）
+	}
+	// 用户消息的审核结果
+	moderationMsg struct {
+		prompt string
+		notes  []string
+		err    error
+	}
+	// 请求在上游流式请求队列中的位置，0 表示已经开始
+	queueMsg struct {
+		pos       int
+		positions <-chan int
+	}
+	// 工具执行结果
+	toolResultMsg struct {
+		callID  string
+		content string
+		err     error
 	}
 )
 
 type message struct {
 	content  string
 	fromUser bool
+	from     string   // 聊天室中其他发送者的名字
+	roomID   int64    // 聊天室消息 ID，用于更新流式生成的 AI 消息
+	tool     bool     // 是否是工具调用的状态消息
+	blocked  bool     // 是否是被审核拒绝的提示，不保存到对话中
+	notes    []string // 审核钩子的提示，显示在消息下方
+	time     time.Time
+	// 模型回复消耗的 token 数
+	promptTokens     int64
+	completionTokens int64
 }
 
 type model struct {
-	openaiClient  openai.Client
+	ctx           context.Context                        // 会话的 context
+	turn          *turnState                             // 进行中的一轮对话
+	stream        *activeStream                          // 进行中的上游流式请求
+	provider      *provider.Provider                     // 模型请求出口
+	mcp           *mcp.Manager                           // MCP 工具服务器
+	tools         []openai.ChatCompletionToolParam       // 暴露给模型的工具
+	pendingTools  []openai.ChatCompletionMessageToolCall // 等待用户确认的工具调用
 	viewport      viewport.Model
 	messages      []string                                 // 渲染后的消息（带样式）
+	messageStart  []int                                    // 每条原始消息在 messages 中的第一项，提示和空行也各占一项
 	rawMessages   []message                                // 原始消息内容（不带样式）
 	chatHistory   []openai.ChatCompletionMessageParamUnion // 聊天历史记录
 	textarea      textarea.Model
@@ -70,6 +126,7 @@ type model struct {
 	receiverStyle lipgloss.Style
 	spinner       spinner.Model
 	isWaiting     bool // 是否正在等待响应
+	queuePos      int  // 请求排队时在队列中的位置
 	err           error
 	program       *tea.Program // 添加程序引用
 	lastMsgDone   bool         // 最后一条消息是否完成
@@ -78,17 +135,52 @@ type model struct {
 	userAlignStyle lipgloss.Style
 	botMsgStyle    lipgloss.Style
 	welcomeStyle   lipgloss.Style
+	welcome        string         // 会话开始时渲染的欢迎消息
+	blockedStyle   lipgloss.Style // 被审核拒绝的提示
+	noteStyle      lipgloss.Style // 审核钩子的提示
 
 	// 渲染缓存相关
 	lastViewportWidth int    // 上次渲染时的视口宽度
 	lastSpinnerFrame  string // 上次渲染时的spinner帧
 	needsReformat     bool   // 是否需要重新格式化
+
+	// 聊天室相关
+	user          string       // 当前用户名
+	room          *roomSession // 所在聊天室，未加入时为私聊
+	roomMembers   []string     // 聊天室在线成员
+	savedMessages []message    // 进入聊天室前的私聊消息
+	initialRoom   string       // 启动后加入的聊天室
+	statusStyle   lipgloss.Style
+
+	// 会话分享相关
+	share         *shareState
+	shareNotice   string // 分享相关的提示
+	shareWritable bool   // 观看时是否可以输入
+	initialWatch  string // 启动后观看的分享码
+
+	created  time.Time                                      // 会话开始时间
+	notice   string                                         // 状态行中的一次性提示
+	exportFn func(name string, data []byte) (string, error) // 导出文件的处理方式
+
+	// 对话保存相关
+	identity    string    // 对话所有者
+	convID      string    // 当前对话在存储中的 ID
+	convTitle   string    // 当前对话的标题
+	convUpdated time.Time // 载入或上次保存对话时的版本
+	convSaved   int       // 那时已经保存的消息数，之后的消息是本会话新增的
+	allowTokens bool      // 是否可以用 /token 管理令牌
+
+	// 搜索结果列表
+	searchResults []store.Result
+	searchSel     int
+
+	drain       *drainState // 服务器正在关闭时不为 nil
+	timer       sessionTimer
+	bannerStyle lipgloss.Style
 }
 
 // NewModel 创建并返回一个新的 UI 模型
-func NewModel() model {
-	openaiClient := openai.NewClient(option.WithBaseURL(openaiBaseURL), option.WithAPIKey(openaiAPIKey))
-
+func NewModel(opts Options) model {
 	ta := textarea.New()
 	ta.Placeholder = "Send a message..."
 	ta.Focus()
@@ -111,7 +203,8 @@ func NewModel() model {
 	vp.Style = lipgloss.NewStyle().
 		Border(lipgloss.RoundedBorder())
 	// 注意：此时viewport尺寸还是0x0，实际的垂直居中会在第一次Update时处理
-	vp.SetContent(lipgloss.NewStyle().Align(lipgloss.Center).Render(welcomeMsg))
+	welcome := motd.MOTD(motd.Data{User: opts.User, Identity: opts.Identity, Model: provider.Default().Model})
+	vp.SetContent(lipgloss.NewStyle().Align(lipgloss.Center).Render(welcome))
 
 	ta.KeyMap.InsertNewline.SetEnabled(false)
 
@@ -136,13 +229,23 @@ func NewModel() model {
 	welcomeStyle := lipgloss.NewStyle().
 		Align(lipgloss.Center)
 
+	mcpManager := mcp.Shared()
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	return model{
-		openaiClient: openaiClient,
-		textarea:     ta,
-		messages:     []string{},
-		rawMessages:  []message{},
+		ctx:         ctx,
+		provider:    provider.Default(),
+		mcp:         mcpManager,
+		tools:       mcpManager.OpenAITools(),
+		textarea:    ta,
+		messages:    []string{},
+		rawMessages: []message{},
 		chatHistory: []openai.ChatCompletionMessageParamUnion{
-			openai.SystemMessage(systemPrompt),
+			openai.SystemMessage(provider.SystemPrompt),
 		},
 		viewport:       vp,
 		senderStyle:    lipgloss.NewStyle(),
@@ -156,19 +259,51 @@ func NewModel() model {
 		userAlignStyle: rightAlignStyle,
 		botMsgStyle:    botMsgStyle,
 		welcomeStyle:   welcomeStyle,
+		welcome:        welcome,
+		blockedStyle:   botMsgStyle.Foreground(lipgloss.Color("9")),
+		noteStyle:      lipgloss.NewStyle().Faint(true).Italic(true),
 
 		// 初始化渲染缓存相关字段
 		lastViewportWidth: 0,
 		lastSpinnerFrame:  "",
 		needsReformat:     true,
+
+		user:        opts.User,
+		room:        &roomSession{},
+		stream:      &activeStream{},
+		statusStyle: lipgloss.NewStyle().Faint(true).PaddingLeft(1),
+		initialRoom: opts.Room,
+
+		share:        &shareState{},
+		initialWatch: opts.Watch,
+
+		created:  time.Now(),
+		exportFn: opts.Export,
+
+		identity:    opts.Identity,
+		allowTokens: opts.AllowTokens,
+
+		bannerStyle: lipgloss.NewStyle().Bold(true).Reverse(true).Padding(0, 1),
+
+		timer: sessionTimer{idle: opts.IdleTimeout, max: opts.MaxDuration, start: time.Now(), lastInput: time.Now()},
 	}
 }
 
 func (m *model) Init() tea.Cmd {
-	return tea.Batch(
+	cmds := []tea.Cmd{
 		textarea.Blink,
 		m.spinner.Tick,
-	)
+		waitForDrain(m.ctx),
+	}
+	if m.timer.idle > 0 || m.timer.max > 0 {
+		cmds = append(cmds, m.timeoutTick())
+	}
+	if m.initialWatch != "" {
+		cmds = append(cmds, m.watch(m.initialWatch))
+	} else if m.initialRoom != "" {
+		cmds = append(cmds, m.joinRoom(m.initialRoom))
+	}
+	return tea.Batch(cmds...)
 }
 
 func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -178,6 +313,28 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		cmds  []tea.Cmd
 	)
 
+	switch msg.(type) {
+	case tea.KeyMsg, tea.MouseMsg:
+		m.touch()
+	}
+
+	// 等待用户确认工具调用时，y/n 不进入输入框
+	if key, ok := msg.(tea.KeyMsg); ok && len(m.pendingTools) > 0 && !m.isWaiting {
+		switch key.String() {
+		case "y", "Y":
+			return m, m.runPendingTool()
+		case "n", "N":
+			return m, m.denyPendingTool()
+		}
+	}
+
+	// 显示搜索结果时，方向键、回车和 Esc 用于选择结果
+	if key, ok := msg.(tea.KeyMsg); ok && len(m.searchResults) > 0 {
+		if m.handleSearchKey(key) {
+			return m, nil
+		}
+	}
+
 	m.textarea, tiCmd = m.textarea.Update(msg)
 	m.viewport, vpCmd = m.viewport.Update(msg)
 
@@ -205,113 +362,76 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.viewport.GotoBottom()
 		} else {
 			// 只有欢迎消息居中显示
-			welcomeMsg := welcomeMsg
-			// 计算垂直居中所需的空行数
-			msgLines := strings.Count(welcomeMsg, "\n") + 1
-			padLines := (m.viewport.Height - msgLines) / 2
-			if padLines > 0 {
-				vertPadding := strings.Repeat("\n", padLines)
-				welcomeMsg = vertPadding + welcomeMsg
-			}
-
-			contentStyle := m.welcomeStyle
-			contentStyle = contentStyle.Width(m.viewport.Width)
-			m.viewport.SetContent(contentStyle.Render(welcomeMsg))
+			m.showWelcome()
 		}
 	case tea.KeyMsg:
 		switch msg.Type {
 		case tea.KeyCtrlC, tea.KeyEsc:
 			fmt.Println(m.textarea.Value())
+			m.Close()
 			return m, tea.Quit
 		case tea.KeyEnter:
 			userMsg := m.textarea.Value()
-			if userMsg != "" && !m.isWaiting {
-				// 检查是否是清空历史的命令
-				if userMsg == "/clear" {
-					// 清空所有消息记录，只保留系统提示
-					m.rawMessages = []message{}
-					m.messages = []string{}
-					m.chatHistory = []openai.ChatCompletionMessageParamUnion{
-						openai.SystemMessage(systemPrompt),
-					}
-
-					// 重设视图，确保欢迎消息居中
-					welcomeMsg := welcomeMsg
-					// 计算垂直居中所需的空行数
-					msgLines := strings.Count(welcomeMsg, "\n") + 1
-					padLines := (m.viewport.Height - msgLines) / 2
-					if padLines > 0 {
-						vertPadding := strings.Repeat("\n", padLines)
-						welcomeMsg = vertPadding + welcomeMsg
-					}
-
-					contentStyle := m.welcomeStyle
-					contentStyle = contentStyle.Width(m.viewport.Width)
-					m.viewport.SetContent(contentStyle.Render(welcomeMsg))
-
+			// 服务器关闭时不再接受新消息，输入保留在输入框中
+			if userMsg == "" || m.drain != nil {
+				break
+			}
+			m.notice = ""
+			if m.share.viewer() != nil {
+				return m, m.handleViewerInput(userMsg)
+			}
+			if m.room.get() != nil {
+				m.textarea.Reset()
+				return m, m.handleRoomInput(userMsg)
+			}
+			if !m.isWaiting && len(m.pendingTools) == 0 {
+				// 先检查是否是斜杠命令
+				if cmd, ok := m.runCommand(userMsg); ok {
 					m.textarea.Reset()
-					return m, nil
+					return m, cmd
 				}
 
-				// 添加用户原始消息到列表
-				userContent := userMsg
-				m.rawMessages = append(m.rawMessages, message{content: userContent, fromUser: true})
-
-				// 添加到聊天历史
-				m.chatHistory = append(m.chatHistory, openai.UserMessage(userMsg))
-
-				// 标记需要重新格式化
-				m.needsReformat = true
-
-				// 先展示用户消息
-				m.formatMessages()
-				m.viewport.GotoBottom()
-
-				// 添加一个加载中的消息
-				m.isWaiting = true
-				m.rawMessages = append(m.rawMessages, message{content: fmt.Sprintf("%s", thinkingText), fromUser: false})
-				m.needsReformat = true
-				m.formatMessages()
-				m.viewport.GotoBottom()
-
 				// 重置输入框
 				m.textarea.Reset()
-
-				// 创建一个命令函数来启动AI响应请求
-				startAIRequest := func() tea.Cmd {
-					return func() tea.Msg {
-						// 创建context，可以在需要时取消
-						ctx := context.Background()
-
-						// 启动流式请求
-						stream := m.openaiClient.Chat.Completions.NewStreaming(ctx, openai.ChatCompletionNewParams{
-							Model:    openaiModel,
-							Messages: m.chatHistory,
-						})
-
-						// 创建新的响应处理器
-						return fetchAIResponseCmd(stream)()
-					}
-				}
-
-				return m, tea.Batch(
-					m.spinner.Tick,
-					startAIRequest(),
-				)
+				return m, m.sendUserMessage(userMsg)
 			}
 		}
 
 	// We handle errors just like any other message
 	case errMsg:
 		m.err = msg
+		m.endTurn("", msg)
 		m.isWaiting = false
 		m.lastMsgDone = true
 		return m, nil
 
 	// 处理AI响应消息
+	case moderationMsg:
+		if msg.err != nil {
+			m.blockTurn(msg.err, msg.prompt)
+			return m, nil
+		}
+		m.annotatePrompt(msg.notes)
+		return m, m.startAIRequest()
+
+	case queueMsg:
+		m.queuePos = msg.pos
+		m.needsReformat = true
+		m.formatMessages()
+		return m, waitForQueue(msg.positions)
+
 	case aiResponseMsg:
+		if !m.stream.is(msg.stream) {
+			// 轮次已经中断，流被关闭后的结果不再显示
+			return m, nil
+		}
+		if errors.As(msg.err, new(*moderation.BlockedError)) {
+			m.blockTurn(msg.err, "")
+			return m, nil
+		}
 		if msg.err != nil {
 			m.err = msg.err
+			m.endTurn("", msg.err)
 			m.isWaiting = false
 			m.lastMsgDone = true
 			return m, nil
@@ -330,20 +450,49 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.lastMsgDone = msg.done
 
 		if msg.done {
-			// 添加完整的AI响应到历史记录
-			m.chatHistory = append(m.chatHistory, openai.AssistantMessage(msg.content))
 			m.isWaiting = false
+			m.addTurnUsage(msg.usage)
 
 			// 删除现有的流式消息（如果有）
 			if len(m.rawMessages) > 0 && !m.rawMessages[len(m.rawMessages)-1].fromUser {
 				m.rawMessages = m.rawMessages[:len(m.rawMessages)-1]
 			}
 
+			if len(msg.toolCalls) > 0 && m.turn != nil && m.turn.requests >= maxToolRounds {
+				// 达到轮数上限：不再执行工具，把已有的内容作为最终回复
+				m.notice = fmt.Sprintf("Stopped after %d rounds of tool calls", maxToolRounds)
+				msg.toolCalls = nil
+			}
+			if len(msg.toolCalls) > 0 {
+				// 模型请求调用工具：记录到历史，逐个等待确认
+				asst := openai.ChatCompletionMessage{Content: msg.content, ToolCalls: msg.toolCalls}
+				m.chatHistory = append(m.chatHistory, asst.ToParam())
+				if msg.content != "" {
+					m.rawMessages = append(m.rawMessages, message{
+						content:          msg.content,
+						time:             time.Now(),
+						promptTokens:     msg.usage.PromptTokens,
+						completionTokens: msg.usage.CompletionTokens,
+					})
+				}
+				m.pendingTools = msg.toolCalls
+				return m, m.nextPendingTool()
+			}
+
+			// 添加完整的AI响应到历史记录
+			m.chatHistory = append(m.chatHistory, openai.AssistantMessage(msg.content))
+			m.endTurn(msg.content, nil)
+
 			// 添加消息，无需标记
 			m.rawMessages = append(m.rawMessages, message{
-				content:  msg.content,
-				fromUser: false,
+				content:          msg.content,
+				fromUser:         false,
+				notes:            msg.notes,
+				time:             time.Now(),
+				promptTokens:     msg.usage.PromptTokens,
+				completionTokens: msg.usage.CompletionTokens,
 			})
+			m.saveConversation()
 		} else {
 			// 流式更新
 			if len(m.rawMessages) > 0 && !m.rawMessages[len(m.rawMessages)-1].fromUser {
@@ -370,6 +519,41 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		return m, nil
 
+	// 处理工具执行结果
+	case toolResultMsg:
+		content := msg.content
+		status := "done"
+		if msg.err != nil {
+			content = fmt.Sprintf("Error: %v", msg.err)
+			status = "failed"
+		}
+		m.isWaiting = false
+		// 工具可能读到密钥等敏感内容，和用户消息一样检查后才放入历史
+		m.chatHistory = append(m.chatHistory, openai.ToolMessage(redact.CheckToolOutput(m.ctx, content), msg.callID))
+		m.replaceLastBotMessage(fmt.Sprintf("%s: %s", m.rawMessages[len(m.rawMessages)-1].content, status))
+		m.pendingTools = m.pendingTools[1:]
+		return m, m.nextPendingTool()
+
+	// 服务器关闭
+	case drainMsg:
+		return m, m.startDrain()
+	case drainTickMsg:
+		return m, m.drainTick()
+
+	// 空闲或会话时间超时
+	case timeoutTickMsg:
+		return m, m.timeoutTick()
+
+	// 处理聊天室事件
+	case roomEventMsg:
+		return m, m.handleRoomEvent(msg)
+
+	// 处理会话分享
+	case shareInputMsg:
+		return m, m.handleShareInput(msg)
+	case shareUpdateMsg:
+		return m, m.handleShareUpdate(msg)
+
 	// 处理spinner tick
 	case spinner.TickMsg:
 		var cmd tea.Cmd
@@ -394,21 +578,41 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 }
 
 func (m *model) View() string {
+	defer m.trackRender(time.Now())
 	return fmt.Sprintf(
-		"%s%s%s",
+		"%s\n%s\n%s",
 		m.viewport.View(),
-		gap,
+		m.statusLine(),
 		m.textarea.View(),
 	)
 }
 
+// showWelcome 在视口中垂直居中显示欢迎消息
+func (m *model) showWelcome() {
+	welcomeMsg := m.welcome
+	// 计算垂直居中所需的空行数
+	msgLines := strings.Count(welcomeMsg, "\n") + 1
+	padLines := (m.viewport.Height - msgLines) / 2
+	if padLines > 0 {
+		vertPadding := strings.Repeat("\n", padLines)
+		welcomeMsg = vertPadding + welcomeMsg
+	}
+
+	contentStyle := m.welcomeStyle
+	contentStyle = contentStyle.Width(m.viewport.Width)
+	m.viewport.SetContent(contentStyle.Render(welcomeMsg))
+	m.publish()
+}
+
 func (m *model) formatMessages() {
+	defer m.trackRender(time.Now())
 	// 如果不需要重新格式化，跳过
 	if !m.needsReformat && len(m.messages) > 0 {
 		return
 	}
 
 	m.messages = []string{}
+	m.messageStart = m.messageStart[:0]
 
 	if len(m.rawMessages) == 0 {
 		return
@@ -431,10 +635,14 @@ func (m *model) formatMessages() {
 	for i, msg := range m.rawMessages {
 		isLastMsg := i == len(m.rawMessages)-1
 		displayContent := msg.content
+		m.messageStart = append(m.messageStart, len(m.messages))
 
 		// 检查是否是最后一条正在加载的消息
 		if isLastMsg && m.isWaiting && !msg.fromUser && strings.Contains(displayContent, thinkingText) {
 			displayContent = fmt.Sprintf("%s %s", thinkingText, m.spinner.View())
+			if m.queuePos > 0 {
+				displayContent = fmt.Sprintf("%s · waiting in line, %s %s", thinkingText, ordinal(m.queuePos), m.spinner.View())
+			}
 		}
 
 		// 如果是最后一条AI消息，并且消息尚未完成，添加spinner
@@ -454,10 +662,23 @@ func (m *model) formatMessages() {
 			// 渲染用户消息并右对齐
 			formattedMsg := contentStyle.Render(displayContent)
 			m.messages = append(m.messages, userAlignStyle.Render(formattedMsg))
+		} else if msg.blocked {
+			m.messages = append(m.messages, m.blockedStyle.Width(msgWidth+marginWidth).Render(displayContent))
 		} else {
 			// 机器人消息样式（左侧）- 使用预创建的样式
+			if msg.from != "" {
+				displayContent = fmt.Sprintf("%s: %s", msg.from, displayContent)
+			}
 			m.messages = append(m.messages, botMsgStyle.Render(displayContent))
 		}
+		if len(msg.notes) > 0 {
+			note := m.noteStyle.Render("Note: " + strings.Join(msg.notes, "; "))
+			if msg.fromUser {
+				m.messages = append(m.messages, userAlignStyle.Render(note))
+			} else {
+				m.messages = append(m.messages, botMsgStyle.Render(note))
+			}
+		}
 
 		// 添加空行分隔消息
 		m.messages = append(m.messages, "")
@@ -465,15 +686,254 @@ func (m *model) formatMessages() {
 
 	// 更新 viewport 内容
 	m.viewport.SetContent(strings.Join(m.messages, "\n"))
+	m.publish()
+}
+
+// sendUserMessage 展示用户消息并开始请求模型。
+// 消息先经过敏感内容检查，展示和保存的都是实际发往模型的内容
+func (m *model) sendUserMessage(userMsg string) tea.Cmd {
+	userMsg, found, err := redact.Check(m.ctx, userMsg)
+	if err != nil {
+		var blocked *redact.BlockedError
+		if errors.As(err, &blocked) {
+			audit.RecordBlocked(m.ctx, m.provider.Model, "", err)
+		}
+		// 被拒绝的消息放回输入框，方便删掉敏感内容后重新发送
+		m.notice = err.Error()
+		m.textarea.SetValue(userMsg)
+		return nil
+	}
+	if len(found) > 0 {
+		m.notice = "Redacted before sending: " + found.String()
+	}
+
+	// 添加用户原始消息到列表
+	m.rawMessages = append(m.rawMessages, message{content: userMsg, fromUser: true, time: time.Now()})
+
+	// 添加到聊天历史
+	m.chatHistory = append(m.chatHistory, openai.UserMessage(userMsg))
+	m.beginTurn(userMsg)
+
+	// 标记需要重新格式化
+	m.needsReformat = true
+
+	// 先展示用户消息
+	m.formatMessages()
+	m.viewport.GotoBottom()
+
+	// 添加一个加载中的消息
+	m.isWaiting = true
+	m.rawMessages = append(m.rawMessages, message{content: thinkingText, fromUser: false})
+	m.needsReformat = true
+	m.formatMessages()
+	m.viewport.GotoBottom()
+
+	return tea.Batch(
+		m.spinner.Tick,
+		m.moderateInput(userMsg),
+	)
+}
+
+// moderateInput 在后台用审核钩子检查用户消息，通过后才请求模型。外部钩子可能需要几秒，不能阻塞界面
+func (m *model) moderateInput(prompt string) tea.Cmd {
+	ctx := m.turnContext()
+	return func() tea.Msg {
+		moderator, err := moderation.Default()
+		if err != nil {
+			return moderationMsg{prompt: prompt, err: err}
+		}
+		notes, err := moderator.Check(ctx, moderation.StageInput, prompt)
+		return moderationMsg{prompt: prompt, notes: notes, err: err}
+	}
+}
+
+// blockTurn 结束被审核拒绝的一轮对话，用醒目的提示代替回复。
+// prompt 不为空时被拒绝的是用户消息：消息从历史中移除并放回输入框，方便修改后重新发送
+func (m *model) blockTurn(err error, prompt string) {
+	m.endTurn("", err)
+	m.isWaiting = false
+	m.lastMsgDone = true
+
+	// 移除思考中的消息或已经生成的部分回复
+	if n := len(m.rawMessages); n > 0 && !m.rawMessages[n-1].fromUser {
+		m.rawMessages = m.rawMessages[:n-1]
+	}
+	if prompt != "" {
+		if n := len(m.rawMessages); n > 0 && m.rawMessages[n-1].fromUser {
+			m.rawMessages = m.rawMessages[:n-1]
+		}
+		m.chatHistory = m.chatHistory[:len(m.chatHistory)-1]
+		if m.textarea.Value() == "" {
+			m.textarea.SetValue(prompt)
+		}
+	}
+
+	text := err.Error()
+	m.rawMessages = append(m.rawMessages, message{
+		content: strings.ToUpper(text[:1]) + text[1:],
+		blocked: true,
+		time:    time.Now(),
+	})
+	m.needsReformat = true
+	m.formatMessages()
+	m.viewport.GotoBottom()
+}
+
+// annotatePrompt 把审核钩子的提示加到最后一条用户消息下方
+func (m *model) annotatePrompt(notes []string) {
+	if len(notes) == 0 {
+		return
+	}
+	for i := len(m.rawMessages) - 1; i >= 0; i-- {
+		if m.rawMessages[i].fromUser {
+			m.rawMessages[i].notes = append(m.rawMessages[i].notes, notes...)
+			m.needsReformat = true
+			m.formatMessages()
+			m.viewport.GotoBottom()
+			return
+		}
+	}
+}
+
+// startAIRequest 创建一个命令来启动AI响应请求，同时进行的请求太多时显示排队的位置
+func (m *model) startAIRequest() tea.Cmd {
+	m.queuePos = 0
+	turn := m.turn
+	if turn != nil {
+		turn.requests++
+	}
+	// 载入的对话没有经过输入时的检查，每次请求都检查完整的历史
+	history, _, err := redact.CheckMessages(m.ctx, m.chatHistory)
+	if err != nil {
+		return func() tea.Msg { return errMsg(err) }
+	}
+	// 只保留最新的位置，队列通知不能阻塞
+	positions := make(chan int, 1)
+	ctx := provider.WithQueueNotify(m.turnContext(), func(pos int) {
+		select {
+		case <-positions:
+		default:
+		}
+		positions <- pos
+	})
+	request := func() tea.Msg {
+		// 启动流式请求，返回后队列不会再发送位置
+		stream := m.provider.NewStreaming(ctx, openai.ChatCompletionNewParams{
+			Messages: history,
+			Tools:    m.tools,
+			StreamOptions: openai.ChatCompletionStreamOptionsParam{
+				IncludeUsage: openai.Bool(true),
+			},
+		})
+		close(positions)
+		if !m.stream.set(turn, stream) {
+			// 排队或连接期间轮次已经结束
+			return nil
+		}
+
+		// 创建新的响应处理器
+		return fetchAIResponseCmd(stream)()
+	}
+	return tea.Batch(request, waitForQueue(positions))
+}
+
+// waitForQueue 等待请求在队列中的下一个位置，请求开始后结束
+func waitForQueue(positions <-chan int) tea.Cmd {
+	return func() tea.Msg {
+		pos, ok := <-positions
+		if !ok {
+			return nil
+		}
+		return queueMsg{pos: pos, positions: positions}
+	}
+}
+
+// ordinal 返回英文序数词，如 1st、2nd、11th
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
+
+// replaceLastBotMessage 替换最后一条消息的内容并重新渲染
+func (m *model) replaceLastBotMessage(content string) {
+	if len(m.rawMessages) > 0 && !m.rawMessages[len(m.rawMessages)-1].fromUser {
+		m.rawMessages[len(m.rawMessages)-1].content = content
+	} else {
+		m.rawMessages = append(m.rawMessages, message{content: content, fromUser: false})
+	}
+	m.needsReformat = true
+	m.formatMessages()
+	m.viewport.GotoBottom()
+}
+
+// nextPendingTool 处理下一个待执行的工具调用，全部完成后继续请求模型
+func (m *model) nextPendingTool() tea.Cmd {
+	if len(m.pendingTools) == 0 {
+		m.isWaiting = true
+		m.lastMsgDone = true
+		m.rawMessages = append(m.rawMessages, message{content: thinkingText, fromUser: false})
+		m.needsReformat = true
+		m.formatMessages()
+		m.viewport.GotoBottom()
+		return tea.Batch(m.spinner.Tick, m.startAIRequest())
+	}
+
+	call := m.pendingTools[0]
+	if m.mcp.AutoApproved(call.Function.Name) {
+		return m.runPendingTool()
+	}
+
+	m.rawMessages = append(m.rawMessages, message{tool: true, time: time.Now()})
+	m.replaceLastBotMessage(fmt.Sprintf("Tool call: %s(%s)\nAllow? [y/n]", call.Function.Name, call.Function.Arguments))
+	// 等待确认算作空闲，从现在开始计时
+	m.touch()
+	return nil
+}
+
+// runPendingTool 执行当前等待确认的工具调用
+func (m *model) runPendingTool() tea.Cmd {
+	call := m.pendingTools[0]
+	if len(m.rawMessages) == 0 || !strings.HasPrefix(m.rawMessages[len(m.rawMessages)-1].content, "Tool call: ") {
+		m.rawMessages = append(m.rawMessages, message{tool: true, time: time.Now()})
+	}
+	m.replaceLastBotMessage(fmt.Sprintf("Tool call: %s(%s)", call.Function.Name, call.Function.Arguments))
+	m.isWaiting = true
+
+	manager := m.mcp
+	turnCtx := m.turnContext()
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(turnCtx, 2*time.Minute)
+		defer cancel()
+		content, err := manager.Call(ctx, call.Function.Name, call.Function.Arguments)
+		return toolResultMsg{callID: call.ID, content: content, err: err}
+	}
+}
+
+// denyPendingTool 拒绝当前工具调用，并把拒绝结果告诉模型
+func (m *model) denyPendingTool() tea.Cmd {
+	call := m.pendingTools[0]
+	m.chatHistory = append(m.chatHistory, openai.ToolMessage("The user denied this tool call.", call.ID))
+	m.replaceLastBotMessage(fmt.Sprintf("Tool call: %s(%s): denied", call.Function.Name, call.Function.Arguments))
+	m.pendingTools = m.pendingTools[1:]
+	return m.nextPendingTool()
 }
 
 // fetchAIResponseCmd 创建一个命令来获取下一个响应块
-func fetchAIResponseCmd(stream *ssestream.Stream[openai.ChatCompletionChunk]) tea.Cmd {
+func fetchAIResponseCmd(stream *provider.Stream) tea.Cmd {
 	return fetchAIResponseCmdWithAccumulator(stream, &openai.ChatCompletionAccumulator{})
 }
 
 // fetchAIResponseCmdWithAccumulator 是fetchAIResponseCmd的辅助函数，接受一个累加器参数
-func fetchAIResponseCmdWithAccumulator(stream *ssestream.Stream[openai.ChatCompletionChunk], acc *openai.ChatCompletionAccumulator) tea.Cmd {
+func fetchAIResponseCmdWithAccumulator(stream *provider.Stream, acc *openai.ChatCompletionAccumulator) tea.Cmd {
 	return func() tea.Msg {
 		if stream.Next() {
 			chunk := stream.Current()
@@ -488,6 +948,7 @@ func fetchAIResponseCmdWithAccumulator(stream *ssestream.Stream[openai.ChatCompl
 					done:         false,
 					err:          nil,
 					nextChunkCmd: fetchAIResponseCmdWithAccumulator(stream, acc), // 传递同一个累加器
+					stream:       stream,
 				}
 			}
 		}
@@ -498,19 +959,52 @@ func fetchAIResponseCmdWithAccumulator(stream *ssestream.Stream[openai.ChatCompl
 				content: "",
 				done:    false,
 				err:     err,
+				stream:  stream,
 			}
 		}
 
 		// 流结束，返回完整内容
 		content := ""
+		var toolCalls []openai.ChatCompletionMessageToolCall
 		if len(acc.Choices) > 0 {
 			content = acc.Choices[0].Message.Content
+			toolCalls = acc.Choices[0].Message.ToolCalls
 		}
 
 		return aiResponseMsg{
-			content: content,
-			done:    true,
-			err:     nil,
+			content:   content,
+			done:      true,
+			err:       nil,
+			toolCalls: toolCalls,
+			usage:     acc.Usage,
+			notes:     stream.Notes(),
+			stream:    stream,
+		}
+	}
+}
+
+// statusLine 返回输入框上方的状态行，没有状态时为空行
+func (m *model) statusLine() string {
+	for _, banner := range []string{m.drainBanner(), m.timeoutBanner()} {
+		if banner != "" {
+			return m.bannerStyle.Render(banner)
 		}
 	}
+	var parts []string
+	for _, status := range []string{m.roomStatus(), m.shareStatus(), m.notice} {
+		if status != "" {
+			parts = append(parts, status)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return m.statusStyle.Render(strings.Join(parts, " | "))
+}
+
+// Close 释放会话占用的资源，会话结束时调用
+func (m *model) Close() {
+	m.stream.close()
+	m.room.swap(nil)
+	m.share.close()
 }
@@ -0,0 +1,189 @@
+package ui
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"sshtalk/audit"
+	"sshtalk/provider"
+	"sshtalk/tracing"
+)
+
+// turnState 是进行中的一轮对话：从发送消息开始，到模型给出最终回复结束。
+// 中间的上游请求和工具调用都是它的 span 的子 span，结束时写入审计日志
+type turnState struct {
+	ctx    context.Context
+	span   trace.Span
+	prompt string
+	start  time.Time
+	usage  openai.CompletionUsage // 所有上游请求的用量之和
+	// 这一轮请求模型的次数，模型调用工具后会再次请求
+	requests int
+	// 这一轮中重新排版和渲染界面花费的时间，用来区分慢在模型还是慢在渲染
+	render  time.Duration
+	renders int
+}
+
+// beginTurn 开始新一轮对话
+func (m *model) beginTurn(prompt string) {
+	// 上一轮没有正常结束时按取消记录
+	m.endTurn("", context.Canceled)
+	ctx, span := tracing.Tracer().Start(m.ctx, "chat turn",
+		trace.WithAttributes(attribute.Int("sshtalk.messages", len(m.chatHistory))),
+	)
+	m.turn = &turnState{ctx: ctx, span: span, prompt: prompt, start: time.Now()}
+	m.stream.begin(m.turn)
+}
+
+// turnContext 返回当前对话轮次的 context，没有进行中的轮次时返回会话的 context
+func (m *model) turnContext() context.Context {
+	if m.turn != nil {
+		return m.turn.ctx
+	}
+	return m.ctx
+}
+
+// addTurnUsage 累加当前轮次的 token 用量，模型调用工具时一轮会有多次请求
+func (m *model) addTurnUsage(usage openai.CompletionUsage) {
+	if m.turn != nil {
+		m.turn.usage.PromptTokens += usage.PromptTokens
+		m.turn.usage.CompletionTokens += usage.CompletionTokens
+	}
+}
+
+// endTurn 结束当前轮次的 span 并写入审计日志
+func (m *model) endTurn(response string, err error) {
+	t := m.turn
+	if t == nil {
+		return
+	}
+	m.turn = nil
+	m.touch()
+	// 中断的回复不再读取，关闭流释放上游请求队列中的空位
+	m.stream.end(t)
+
+	t.span.SetAttributes(
+		attribute.Int64("sshtalk.render_ms", t.render.Milliseconds()),
+		attribute.Int("sshtalk.renders", t.renders),
+	)
+	if err != nil {
+		tracing.RecordError(t.span, err)
+	}
+	t.span.End()
+
+	e := audit.Entry{
+		Model:            m.provider.Model,
+		Prompt:           t.prompt,
+		Response:         response,
+		PromptTokens:     t.usage.PromptTokens,
+		CompletionTokens: t.usage.CompletionTokens,
+		Outcome:          audit.Outcome(err),
+		DurationMS:       time.Since(t.start).Milliseconds(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	audit.Record(t.ctx, e)
+}
+
+// trackRender 把从 start 开始的渲染时间计入当前轮次，用法：defer m.trackRender(time.Now())
+func (m *model) trackRender(start time.Time) {
+	if m.turn != nil {
+		m.turn.render += time.Since(start)
+		m.turn.renders++
+	}
+}
+
+// interruptTurn 在会话必须结束时中断进行中的回复，已经生成的部分保存到对话中，err 是审计日志中的原因
+func (m *model) interruptTurn(err error) {
+	partial := ""
+	if n := len(m.rawMessages); n > 0 {
+		last := &m.rawMessages[n-1]
+		switch {
+		case last.fromUser || last.tool:
+		case m.isWaiting && last.content == thinkingText:
+			m.rawMessages = m.rawMessages[:n-1]
+		default:
+			partial = last.content
+			last.time = time.Now()
+		}
+	}
+	if partial != "" {
+		m.chatHistory = append(m.chatHistory, openai.AssistantMessage(partial))
+	}
+	m.pendingTools = nil
+	m.isWaiting = false
+	m.lastMsgDone = true
+	m.endTurn(partial, err)
+	m.saveConversation()
+
+	m.needsReformat = true
+	m.formatMessages()
+	m.viewport.GotoBottom()
+}
+
+// activeStream 保存当前轮次正在进行的上游流式请求，轮次结束或会话关闭时关闭它。
+// 流在命令的 goroutine 中创建，会话断开时 Close 在其他 goroutine 中调用，所以用锁保护
+type activeStream struct {
+	mu     sync.Mutex
+	turn   *turnState // 进行中的轮次
+	stream *provider.Stream
+	closed bool // 会话已经关闭
+}
+
+// begin 记录新开始的轮次
+func (a *activeStream) begin(turn *turnState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.turn = turn
+}
+
+// set 记录 turn 新发起的流。轮次已经结束或会话已经关闭时关闭流并返回 false
+func (a *activeStream) set(turn *turnState, stream *provider.Stream) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed || turn == nil || turn != a.turn {
+		stream.Close()
+		return false
+	}
+	a.stream = stream
+	return true
+}
+
+// is 返回 stream 是否是当前轮次的流
+func (a *activeStream) is(stream *provider.Stream) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return stream != nil && stream == a.stream
+}
+
+// end 在轮次结束时关闭它的流，已经读完的流不受影响
+func (a *activeStream) end(turn *turnState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if turn != a.turn {
+		return
+	}
+	a.closeLocked()
+	a.turn = nil
+}
+
+// close 在会话关闭时关闭进行中的流，之后发起的流会被立即关闭
+func (a *activeStream) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	a.closeLocked()
+}
+
+func (a *activeStream) closeLocked() {
+	if a.stream != nil {
+		a.stream.Close()
+		a.stream = nil
+	}
+}